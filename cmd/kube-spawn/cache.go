@@ -0,0 +1,205 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cache"
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+var (
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of downloaded files",
+	}
+
+	cacheListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "List the cached artifacts",
+		Run:   runCacheList,
+	}
+
+	cacheVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Check the cached files against their recorded digests",
+		Long: `Check the cached files against their recorded digests
+
+Corrupt files are downloaded again the next time they are needed.`,
+		Run: runCacheVerify,
+	}
+
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached artifacts",
+		Long: `Remove cached artifacts
+
+Without options, all artifacts not used by an existing cluster are
+removed. Artifacts used by a cluster and artifacts used within the last
+hour are always kept.`,
+		Example: `
+# Keep the two newest Kubernetes versions
+$ sudo ./kube-spawn cache prune --keep-versions 2
+
+# Remove artifacts not used for a month
+$ sudo ./kube-spawn cache prune --older-than 720h`,
+		Run:         runCachePrune,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheListCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+
+	cacheListCmd.Flags().Bool("files", false, "List the cached files with their source URL and digest")
+	cachePruneCmd.Flags().Int("keep-versions", 0, "Keep the given number of newest versions of every artifact")
+	cachePruneCmd.Flags().Duration("older-than", 0, "Only remove artifacts not used for the given duration")
+	cachePruneCmd.Flags().Bool("dry-run", false, "Only show what would be removed")
+}
+
+func openCache() *cache.Cache {
+	clusterCache, err := cache.New(path.Join(viper.GetString("dir"), "cache"))
+	if err != nil {
+		log.Fatalf("Failed to create cache object: %v", err)
+	}
+	return clusterCache
+}
+
+func runCacheList(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command list doesn't take arguments, got: %v", args)
+	}
+
+	clusterCache := openCache()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	if viper.GetBool("files") {
+		entries, err := clusterCache.Entries()
+		if err != nil {
+			log.Fatalf("Failed to read cache index: %v", err)
+		}
+		fmt.Fprintln(w, "PATH\tSIZE\tDIGEST\tVERIFIED\tURL")
+		for _, entry := range entries {
+			fmt.Fprintf(w, "%s\t%s\t%s:%s\t%t\t%s\n", entry.Path, utils.FormatBytes(entry.Size), entry.Algorithm, entry.Digest, entry.Verified, entry.URL)
+		}
+		return
+	}
+
+	artifacts, err := clusterCache.Artifacts()
+	if err != nil {
+		log.Fatalf("Failed to read cache index: %v", err)
+	}
+	inUse, err := cluster.CacheArtifactsInUse(path.Join(viper.GetString("dir"), "clusters"))
+	if err != nil {
+		log.Fatalf("Failed to determine artifacts used by clusters: %v", err)
+	}
+	var total int64
+	fmt.Fprintln(w, "ARTIFACT\tVERSION\tARCH\tFILES\tSIZE\tLAST USED\tIN USE")
+	for _, artifact := range artifacts {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%s\t%t\n", artifact.Name, artifact.Version, artifact.Arch, len(artifact.Entries), utils.FormatBytes(artifact.Size()), artifact.LastUsed().Local().Format("2006-01-02 15:04"), inUse(artifact))
+		total += artifact.Size()
+	}
+	fmt.Fprintf(w, "\t\t\t\t%s\t\t\n", utils.FormatBytes(total))
+}
+
+func runCacheVerify(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command verify doesn't take arguments, got: %v", args)
+	}
+
+	clusterCache := openCache()
+	entries, err := clusterCache.Entries()
+	if err != nil {
+		log.Fatalf("Failed to read cache index: %v", err)
+	}
+	failed := 0
+	for _, entry := range entries {
+		if err := clusterCache.Verify(entry); err != nil {
+			fmt.Printf("FAILED %s: %v\n", entry.Path, err)
+			failed++
+			continue
+		}
+		fmt.Printf("OK     %s\n", entry.Path)
+	}
+	if failed > 0 {
+		log.Fatalf("%d of %d cached files failed verification, they are downloaded again when needed", failed, len(entries))
+	}
+	log.Printf("All %d cached files verified", len(entries))
+}
+
+func runCachePrune(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command prune doesn't take arguments, got: %v", args)
+	}
+	if viper.GetInt("keep-versions") < 0 {
+		log.Fatalf("--keep-versions must not be negative")
+	}
+
+	inUse, err := cluster.CacheArtifactsInUse(path.Join(viper.GetString("dir"), "clusters"))
+	if err != nil {
+		log.Fatalf("Failed to determine artifacts used by clusters: %v", err)
+	}
+	dryRun := viper.GetBool("dry-run")
+	removed, kept, err := openCache().Prune(&cache.PruneSettings{
+		KeepVersions: viper.GetInt("keep-versions"),
+		OlderThan:    viper.GetDuration("older-than"),
+		InUse:        inUse,
+		DryRun:       dryRun,
+	})
+
+	action := "Removed"
+	if dryRun {
+		action = "Would remove"
+	}
+	var freed int64
+	for _, artifact := range removed {
+		fmt.Printf("%s %s\n", action, describeArtifact(artifact))
+		freed += artifact.Size()
+	}
+	for _, artifact := range kept {
+		fmt.Printf("Keeping %s, it is used by a cluster\n", describeArtifact(artifact))
+	}
+	if err != nil {
+		log.Fatalf("Failed to prune cache: %v", err)
+	}
+	log.Printf("%s %d artifacts, %s", action, len(removed), utils.FormatBytes(freed))
+}
+
+func describeArtifact(artifact *cache.Artifact) string {
+	desc := artifact.Name
+	if artifact.Version != "" {
+		desc += " " + artifact.Version
+	}
+	if artifact.Arch != "" {
+		desc += " (" + artifact.Arch + ")"
+	}
+	return fmt.Sprintf("%s, last used %s", desc, artifact.LastUsed().Local().Format(time.RFC3339))
+}
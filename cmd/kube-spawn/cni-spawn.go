@@ -32,16 +32,18 @@ var (
 		Hidden: true,
 		Run:    runCNISpawn,
 	}
-	cniPluginDir string
+	cniPluginDir   string
+	cniContainerID string
 )
 
 func init() {
 	kubespawnCmd.AddCommand(cniSpawnCmd)
 	cniSpawnCmd.Flags().StringVar(&cniPluginDir, "cni-plugin-dir", "/opt/cni/bin", "path to CNI plugin directory")
+	cniSpawnCmd.Flags().StringVar(&cniContainerID, "container-id", "", "container ID to record in the CNI IPAM lease (default: name of the network namespace)")
 }
 
 func runCNISpawn(cmd *cobra.Command, args []string) {
-	if err := cnispawn.Spawn(cniPluginDir, args); err != nil {
+	if err := cnispawn.Spawn(cniPluginDir, cniContainerID, args); err != nil {
 		fmt.Fprintf(os.Stderr, "%s\n", err)
 		os.Exit(1)
 	}
@@ -17,8 +17,12 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
+	"os"
 	"path"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -26,7 +30,7 @@ import (
 	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
 	"github.com/kinvolk/kube-spawn/pkg/cache"
 	"github.com/kinvolk/kube-spawn/pkg/cluster"
-	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+	"github.com/kinvolk/kube-spawn/pkg/lock"
 )
 
 var (
@@ -37,9 +41,16 @@ var (
 # Create a cluster using a custom hyperkube image
 $ sudo ./kube-spawn create --hyperkube-image 10.22.0.1:5000/me/my-hyperkube-amd64-image:my-test
 
+# Build Kubernetes from source, push a hyperkube image and create a cluster with it
+$ sudo ./kube-spawn create --build --kubernetes-source-dir $GOPATH/src/k8s.io/kubernetes --hyperkube-image 10.22.0.1:5000/me/hyperkube-amd64:my-test
+
+# Create a cluster with a node group running kubelets two minor versions behind
+$ sudo ./kube-spawn create --kubernetes-version v1.13.4 --node-group old=v1.11.8
+
 # Create a cluster using rkt as the container runtime
 $ sudo ./kube-spawn create --container-runtime rkt --rktlet-binary-path $GOPATH/src/github.com/kubernetes-incubator/rktlet/bin/rktlet`,
-		Run: runCreate,
+		Run:         runCreate,
+		Annotations: requiresRoot,
 	}
 )
 
@@ -49,6 +60,7 @@ func init() {
 	createCmd.Flags().String("container-runtime", "docker", "Runtime to use for the cluster (can be docker or rkt)")
 	createCmd.Flags().String("kubernetes-version", "v1.12.3", "Kubernetes version to install")
 	createCmd.Flags().String("kubernetes-source-dir", "", "Path to directory with Kubernetes sources")
+	createCmd.Flags().Bool("build", false, "Build the Kubernetes binaries (and the hyperkube image, if given) in the Kubernetes source dir first")
 	createCmd.Flags().String("hyperkube-image", "", "Kubernetes hyperkube image to use (if unset, upstream k8s is installed)")
 	createCmd.Flags().String("cni-plugin-dir", "/opt/cni/bin", "Path to directory with CNI plugins")
 	createCmd.Flags().String("cni-plugin", "weave", "CNI plugin to use (weave, flannel, calico, canal)")
@@ -57,6 +69,7 @@ func init() {
 	createCmd.Flags().String("rkt-binary-path", "/usr/local/bin/rkt", "Path to rkt binary")
 	createCmd.Flags().String("rkt-stage1-image-path", "/usr/local/bin/stage1-coreos.aci", "Path to rkt stage1-coreos.aci image")
 	createCmd.Flags().String("rktlet-binary-path", "/usr/local/bin/rktlet", "Path to rktlet binary")
+	createCmd.Flags().StringSlice("node-group", nil, "Node group with its own Kubernetes version as NAME=VERSION, e.g. old=v1.11.8 (can be given multiple times)")
 }
 
 func runCreate(cmd *cobra.Command, args []string) {
@@ -64,27 +77,46 @@ func runCreate(cmd *cobra.Command, args []string) {
 		log.Fatalf("Command create doesn't take arguments, got: %v", args)
 	}
 
-	doCreate()
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	kluster, clusterLock := lockNewCluster()
+	defer clusterLock.Release()
+
+	doCreate(ctx, kluster)
 }
 
-func doCreate() {
+// lockNewCluster creates the directory of the cluster given with
+// --cluster-name and takes the cluster lock, for which the directory
+// has to exist. `Create` fails if the cluster was created already.
+func lockNewCluster() (*cluster.Cluster, *lock.Lock) {
 	kubespawnDir := viper.GetString("dir")
-	clusterName := viper.GetString("cluster-name")
-	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
-	if exists, err := fs.PathExists(clusterDir); err != nil {
-		log.Fatalf("Failed to stat directory %q: %s\n", err)
-	} else if exists {
-		log.Fatalf("Cluster directory exists already at %q", clusterDir)
-	}
 
 	// TODO
 	if err := bootstrap.PathSupportsOverlay(kubespawnDir); err != nil {
 		log.Fatalf("Unable to use overlayfs on underlying filesystem of %q: %v", kubespawnDir, err)
 	}
 
-	kluster, err := cluster.New(clusterDir, clusterName)
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+	if err := os.MkdirAll(clusterDir, 0755); err != nil {
+		log.Fatalf("Failed to create directory %q: %v", clusterDir, err)
+	}
+	kluster := clusterByName(clusterName)
+	return kluster, lockCluster(kluster)
+}
+
+// doCreate creates the cluster, the caller has to hold the cluster lock
+func doCreate(ctx context.Context, kluster *cluster.Cluster) {
+	configureArch()
+	configureDownloads()
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+
+	nodeGroups, err := parseNodeGroups(viper.GetStringSlice("node-group"))
 	if err != nil {
-		log.Fatalf("Failed to create cluster object: %v", err)
+		log.Fatalf("Invalid node group: %v", err)
 	}
 
 	clusterSettings := &cluster.ClusterSettings{
@@ -99,6 +131,21 @@ func doCreate() {
 		RktStage1ImagePath:  viper.GetString("rkt-stage1-image-path"),
 		RktletBinaryPath:    viper.GetString("rktlet-binary-path"),
 		HyperkubeImage:      viper.GetString("hyperkube-image"),
+		NodeGroups:          nodeGroups,
+		ProxyEnv:            bootstrap.ProxyEnvironment(),
+	}
+
+	if viper.GetBool("build") {
+		if clusterSettings.KubernetesSourceDir == "" {
+			log.Fatalf("--build requires --kubernetes-source-dir")
+		}
+		buildSettings := &cluster.BuildSettings{
+			KubernetesSourceDir: clusterSettings.KubernetesSourceDir,
+			HyperkubeImage:      clusterSettings.HyperkubeImage,
+		}
+		if err := cluster.BuildKubernetes(ctx, buildSettings); err != nil {
+			log.Fatalf("Failed to build Kubernetes: %v", err)
+		}
 	}
 
 	clusterCache, err := cache.New(path.Join(kubespawnDir, "cache"))
@@ -106,9 +153,25 @@ func doCreate() {
 		log.Fatalf("Failed to create cache object: %v", err)
 	}
 
-	if err := kluster.Create(clusterSettings, clusterCache); err != nil {
+	if err := kluster.Create(ctx, clusterSettings, clusterCache); err != nil {
 		log.Fatalf("Failed to create cluster: %v", err)
 	}
 
 	log.Printf("Cluster %s created", clusterName)
 }
+
+// parseNodeGroups parses node groups given as NAME=VERSION
+func parseNodeGroups(values []string) ([]cluster.NodeGroup, error) {
+	var nodeGroups []cluster.NodeGroup
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("expected NAME=VERSION, got %q", value)
+		}
+		nodeGroups = append(nodeGroups, cluster.NodeGroup{
+			Name:              parts[0],
+			KubernetesVersion: parts[1],
+		})
+	}
+	return nodeGroups, nil
+}
@@ -28,10 +28,11 @@ import (
 
 var (
 	destroyCmd = &cobra.Command{
-		Use:   "destroy",
-		Short: "Destroy a cluster",
-		Long:  "Destroy a cluster",
-		Run:   runDestroy,
+		Use:         "destroy",
+		Short:       "Destroy a cluster",
+		Long:        "Destroy a cluster",
+		Run:         runDestroy,
+		Annotations: requiresRoot,
 	}
 )
 
@@ -53,6 +54,9 @@ func runDestroy(cmd *cobra.Command, args []string) {
 		log.Fatalf("Failed to create cluster object: %v", err)
 	}
 
+	clusterLock := lockCluster(kluster)
+	defer clusterLock.Release()
+
 	log.Printf("Destroying cluster %s ...", clusterName)
 
 	if err := kluster.Destroy(); err != nil {
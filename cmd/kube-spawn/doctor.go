@@ -0,0 +1,103 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+)
+
+var (
+	doctorCmd = &cobra.Command{
+		Use:   "doctor",
+		Short: "Check whether the host can run kube-spawn clusters",
+		Long: `Check whether the host can run kube-spawn clusters
+
+All checks are read-only: requirements which "start" sets up itself, like
+loading kernel modules or adding iptables rules, are reported as warnings.
+Every check which doesn't pass comes with a hint how to fix it. Exits with
+status 1 if a check failed. Runs without root privileges as well, but then
+skips the checks which need them.`,
+		Example: `
+# Check for a cluster with 5 nodes using flannel
+$ sudo ./kube-spawn doctor --nodes 5 --cni-plugin flannel
+
+# Machine-readable output
+$ sudo ./kube-spawn doctor --json | jq '.[] | select(.status != "ok")'`,
+		Run: runDoctor,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(doctorCmd)
+
+	doctorCmd.Flags().IntP("nodes", "n", 3, "Number of nodes to check for")
+	doctorCmd.Flags().String("cni-plugin-dir", "/opt/cni/bin", "Path to directory with CNI plugins")
+	doctorCmd.Flags().String("cni-plugin", "weave", "CNI plugin (weave, flannel, calico, canal)")
+	doctorCmd.Flags().String("base-image", bootstrap.DefaultBaseImage, baseImageUsage())
+	doctorCmd.Flags().Bool("json", false, "Print the results as JSON")
+}
+
+func runDoctor(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command doctor doesn't take arguments, got: %v", args)
+	}
+
+	checks := cluster.Doctor(&cluster.DoctorSettings{
+		Dir:          viper.GetString("dir"),
+		CNIPluginDir: viper.GetString("cni-plugin-dir"),
+		CNIPlugin:    viper.GetString("cni-plugin"),
+		BaseImage:    viper.GetString("base-image"),
+		Nodes:        viper.GetInt("nodes"),
+	})
+
+	if viper.GetBool("json") {
+		out, err := json.MarshalIndent(checks, "", "  ")
+		if err != nil {
+			log.Fatalf("Failed to encode results: %v", err)
+		}
+		fmt.Println(string(out))
+	} else {
+		printChecks(checks)
+	}
+
+	for _, check := range checks {
+		if check.Status == bootstrap.CheckFail {
+			os.Exit(1)
+		}
+	}
+}
+
+// printChecks prints one line per check, followed by the hint if there
+// is one
+func printChecks(checks []bootstrap.Check) {
+	for _, check := range checks {
+		fmt.Printf("%-4s  %s: %s\n", strings.ToUpper(string(check.Status)), check.Name, check.Message)
+		if check.Hint != "" {
+			fmt.Printf("      hint: %s\n", check.Hint)
+		}
+	}
+}
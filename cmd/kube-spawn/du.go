@@ -0,0 +1,99 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+var (
+	duCmd = &cobra.Command{
+		Use:   "du [CLUSTER]",
+		Short: "Show the disk space used by clusters",
+		Long: `Show the disk space used by clusters
+
+Without argument, the usage of all clusters is summarized. With the name
+of a cluster, the usage of each of its nodes is shown: the machine image,
+the upper dir of the node's rootfs and the data of the container runtime.
+Files shared with the cache or between images are counted for each user.`,
+		Run:         runDu,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(duCmd)
+}
+
+func runDu(cmd *cobra.Command, args []string) {
+	if len(args) > 1 {
+		log.Fatalf("Command du takes at most one cluster name, got: %v", args)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	defer w.Flush()
+
+	if len(args) == 1 {
+		kluster := clusterByName(args[0])
+		usage, err := kluster.DiskUsage()
+		if err != nil {
+			log.Fatalf("Failed to determine disk usage: %v", err)
+		}
+		fmt.Fprintln(w, "NODE\tIMAGE\tROOTFS\tCONTAINERS\tTOTAL")
+		for _, node := range usage.Nodes {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", kluster.ShortMachineName(node.Name), utils.FormatBytes(node.Image), utils.FormatBytes(node.Rootfs), utils.FormatBytes(node.Containers), utils.FormatBytes(node.Total()))
+		}
+		fmt.Fprintf(w, "(base rootfs)\t\t\t\t%s\n", utils.FormatBytes(usage.BaseRootfs))
+		fmt.Fprintf(w, "(other files)\t\t\t\t%s\n", utils.FormatBytes(usage.Other))
+		fmt.Fprintf(w, "\t\t\t\t%s\n", utils.FormatBytes(usage.Total()))
+		return
+	}
+
+	names, err := clusterNames()
+	if err != nil {
+		log.Fatalf("Failed to list clusters: %v", err)
+	}
+	var total int64
+	fmt.Fprintln(w, "CLUSTER\tNODES\tBASE ROOTFS\tNODE USAGE\tOTHER\tTOTAL")
+	for _, name := range names {
+		usage, err := clusterByName(name).DiskUsage()
+		if err != nil {
+			log.Fatalf("Failed to determine disk usage of cluster %q: %v", name, err)
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%s\n", name, len(usage.Nodes), utils.FormatBytes(usage.BaseRootfs), utils.FormatBytes(usage.NodesTotal()), utils.FormatBytes(usage.Other), utils.FormatBytes(usage.Total()))
+		total += usage.Total()
+	}
+	fmt.Fprintf(w, "\t\t\t\t\t%s\n", utils.FormatBytes(total))
+}
+
+func clusterByName(name string) *cluster.Cluster {
+	kluster, err := cluster.New(path.Join(viper.GetString("dir"), "clusters", name), name)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+	return kluster
+}
@@ -0,0 +1,153 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/multiprint"
+)
+
+var (
+	execCmd = &cobra.Command{
+		Use:   "exec [NODE] -- COMMAND [ARGS...]",
+		Short: "Run a command on one or all nodes of a running cluster",
+		Long: `Run a command on one or all nodes of a running cluster
+
+NODE can be the full or short machine name (e.g. worker-fpllng), "master"
+for the master node or "worker-N" for the N-th worker node. With --all,
+the command is run on all nodes in parallel and the output is prefixed
+with the node name.
+
+The exit code of the command is passed on. With --all, kube-spawn exits
+with the exit code of the first failed node.`,
+		Example: `
+# Show the kubelet status on the master node
+$ sudo ./kube-spawn exec master -- systemctl status kubelet
+
+# List the docker containers on all nodes
+$ sudo ./kube-spawn exec --all -- docker ps`,
+		Run:         runExec,
+		Annotations: requiresRoot,
+	}
+	flagExecAll bool
+)
+
+func init() {
+	kubespawnCmd.AddCommand(execCmd)
+	execCmd.Flags().BoolVarP(&flagExecAll, "all", "a", false, "Run the command on all nodes in parallel")
+}
+
+func runExec(cmd *cobra.Command, args []string) {
+	var (
+		node    string
+		command []string
+	)
+	dashAt := cmd.ArgsLenAtDash()
+	switch {
+	case flagExecAll && dashAt <= 0 && len(args) > 0:
+		command = args
+	case !flagExecAll && dashAt == 1 && len(args) > 1:
+		node, command = args[0], args[1:]
+	default:
+		log.Fatalf("Usage: %s", cmd.UseLine())
+	}
+
+	// `machinectl shell` requires an absolute path on older systemd
+	// versions, let env(1) look up the command in $PATH
+	if !strings.HasPrefix(command[0], "/") {
+		command = append([]string{"/usr/bin/env"}, command...)
+	}
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if !flagExecAll {
+		machine, err := kluster.ResolveMachine(node)
+		if err != nil {
+			log.Fatalf("Failed to find node: %v", err)
+		}
+		_, err = machinectl.RunCommandContext(ctx, os.Stdout, os.Stderr, "", "shell", machine.Name, command...)
+		if err != nil {
+			if _, ok := err.(*machinectl.CommandError); !ok {
+				log.Printf("Failed to run command on %s: %v", machine.Name, err)
+			}
+		}
+		os.Exit(machinectl.ExitCode(err))
+	}
+
+	os.Exit(execAll(ctx, kluster, command))
+}
+
+// execAll runs the command on all machines of the cluster in parallel
+// and returns the exit code of the first failed one
+func execAll(ctx context.Context, kluster *cluster.Cluster, command []string) int {
+	machines, err := kluster.Machines()
+	if err != nil {
+		log.Fatalf("Failed to list machines: %v", err)
+	}
+	if len(machines) == 0 {
+		log.Fatalf("No machines running in cluster")
+	}
+
+	multiPrinter := multiprint.New(ctx)
+	multiPrinter.RunPrintLoop()
+
+	exitCodes := make([]int, len(machines))
+	var wg sync.WaitGroup
+	wg.Add(len(machines))
+	for i, machine := range machines {
+		go func(i int, machineName string) {
+			defer wg.Done()
+			writer := multiPrinter.NewWriter(fmt.Sprintf("%s ", kluster.ShortMachineName(machineName)))
+			_, err := machinectl.RunCommandContext(ctx, writer, writer, "", "shell", machineName, command...)
+			if err != nil {
+				fmt.Fprintf(writer, "%v\n", err)
+			}
+			exitCodes[i] = machinectl.ExitCode(err)
+		}(i, machine.Name)
+	}
+	wg.Wait()
+	multiPrinter.Close()
+
+	for _, exitCode := range exitCodes {
+		if exitCode != 0 {
+			return exitCode
+		}
+	}
+	return 0
+}
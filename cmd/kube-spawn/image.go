@@ -0,0 +1,82 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/lock"
+)
+
+var (
+	imageCmd = &cobra.Command{
+		Use:   "image",
+		Short: "Manage base images for cluster nodes",
+	}
+
+	imageImportCmd = &cobra.Command{
+		Use:   "import FILE|DIR",
+		Short: "Import a base image from a local raw image, tar archive or directory",
+		Long: `Import a base image from a local raw image, tar archive or directory
+
+The image is imported into the machined image pool and can be used with
+"start --base-image NAME" afterwards. When imported with the name of a
+built-in base image (e.g. "flatcar" or "debian"), it is used by
+"start --base-image" with that name instead of downloading the image. Imported images must contain all packages kube-spawn needs.`,
+		Example: `
+# Use a previously downloaded Flatcar image without network access
+$ sudo ./kube-spawn image import --name flatcar flatcar_developer_container.bin
+
+# Import a directory tree and start a cluster with it
+$ sudo ./kube-spawn image import --name my-image ./rootfs
+$ sudo ./kube-spawn start --base-image my-image`,
+		Run:         runImageImport,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(imageCmd)
+	imageCmd.AddCommand(imageImportCmd)
+
+	imageImportCmd.Flags().String("name", "", "Name of the imported image (default: derived from the file name)")
+	imageImportCmd.Flags().Bool("grow-pool", false, "Grow the machine pool if it is too small for the image")
+}
+
+func runImageImport(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Command import takes exactly one file or directory argument, got: %v", args)
+	}
+
+	// Importing might have to grow the storage pool
+	hostLock, err := lock.AcquireHost(viper.GetDuration("wait-lock"))
+	if err != nil {
+		log.Fatalf("Failed to lock host: %v", err)
+	}
+	defer hostLock.Release()
+
+	baseImage, err := bootstrap.ImportBaseImage(args[0], viper.GetString("name"), viper.GetBool("grow-pool"))
+	if err != nil {
+		log.Fatalf("Failed to import image: %v", err)
+	}
+
+	log.Printf("Image %q imported, use it with `kube-spawn start --base-image %s`", baseImage.Name, baseImage.Name)
+}
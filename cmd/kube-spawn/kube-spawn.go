@@ -17,15 +17,25 @@ limitations under the License.
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"golang.org/x/sys/unix"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/lock"
 )
 
+const requiresRootAnnotation = "requires-root"
+
 var (
 	kubespawnCmd = &cobra.Command{
 		Use:   "kube-spawn",
@@ -42,6 +52,10 @@ You can run a release-version cluster or spawn one from a custom hyperkube image
 			}
 		},
 	}
+	// requiresRoot are the annotations of the commands which have to be
+	// run as root
+	requiresRoot = map[string]string{requiresRootAnnotation: "true"}
+
 	// set from ldflags to current git version during build
 	version string
 
@@ -59,20 +73,55 @@ func init() {
 	kubespawnCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default \"/etc/kube-spawn/config.yaml\")")
 	kubespawnCmd.PersistentFlags().StringP("dir", "d", "/var/lib/kube-spawn", "Path to kube-spawn asset directory")
 	kubespawnCmd.PersistentFlags().StringP("cluster-name", "c", "default", "Name for the cluster")
+	kubespawnCmd.PersistentFlags().Duration("wait-lock", 0, "Wait up to the given duration for other kube-spawn processes using the cluster to finish (default: fail immediately)")
+	kubespawnCmd.PersistentFlags().String("arch", "", fmt.Sprintf("Architecture to download binaries and images for, one of %s (default: the host's)", strings.Join(bootstrap.SupportedArchs(), ", ")))
+	kubespawnCmd.PersistentFlags().Int("download-concurrency", 4, "Maximum number of files to download at the same time")
+	kubespawnCmd.PersistentFlags().Int("download-retries", 3, "Number of times a failed download is retried")
 
 	kubespawnCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
-		cmdName := cmd.Use
-		if cmdName == "create" || cmdName == "destroy" || cmdName == "start" || cmdName == "stop" || cmdName == "up" {
-			if unix.Geteuid() != 0 {
-				cmd.SilenceUsage = true
-				return fmt.Errorf("root privileges required for command %q, aborting", cmdName)
-			}
+		if cmd.Annotations[requiresRootAnnotation] == "true" && unix.Geteuid() != 0 {
+			cmd.SilenceUsage = true
+			return fmt.Errorf("root privileges required for command %q, aborting", cmd.CommandPath())
 		}
 		err := viper.BindPFlags(cmd.Flags())
 		return err
 	}
 }
 
+// configureDownloads applies the download settings and the mirrors from
+// the `mirrors` section of the config file. Like configureArch, it is
+// only called by the commands which download, so that a broken mirror
+// setting doesn't keep the others from working.
+func configureDownloads() {
+	bootstrap.DefaultDownloader.Concurrency = viper.GetInt("download-concurrency")
+	bootstrap.DefaultDownloader.Retries = viper.GetInt("download-retries")
+	bootstrap.DefaultDownloader.Progress = os.Stderr
+
+	if err := bootstrap.SetMirrors(bootstrap.Mirrors{
+		Kubernetes:        viper.GetString("mirrors.kubernetes"),
+		KubernetesSystemd: viper.GetString("mirrors.kubernetes-systemd"),
+		Socat:             viper.GetString("mirrors.socat"),
+		Flatcar:           viper.GetString("mirrors.flatcar"),
+	}); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureArch sets the architecture to download and build for. It is
+// only called by the commands which do, so that the others also work on
+// hosts kube-spawn can't download anything for.
+func configureArch() {
+	if err := bootstrap.SetArch(viper.GetString("arch")); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// baseImageUsage is the help of the --base-image flag
+func baseImageUsage() string {
+	return fmt.Sprintf("Base image for the nodes (%s) or path to a raw or tar image file; %s are not signed and need --insecure-skip-image-verify",
+		strings.Join(bootstrap.BaseImageNames(), ", "), strings.Join(bootstrap.UnsignedBaseImageNames(), " and "))
+}
+
 func initConfig() {
 	if cfgFile != "" {
 		viper.SetConfigFile(cfgFile)
@@ -89,6 +138,35 @@ func initConfig() {
 	}
 }
 
+// lockCluster takes the cluster lock or exits if the cluster is busy
+func lockCluster(kluster *cluster.Cluster) *lock.Lock {
+	clusterLock, err := kluster.Lock(viper.GetDuration("wait-lock"))
+	if err != nil {
+		log.Fatalf("Failed to lock cluster: %v", err)
+	}
+	return clusterLock
+}
+
+// signalContext returns a context which is cancelled on SIGINT or
+// SIGTERM. Only the first signal is handled, a second one terminates
+// kube-spawn immediately without cleaning up.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			log.Printf("Received %s, cancelling and cleaning up (repeat to exit immediately) ...", sig)
+			signal.Stop(sigChan)
+			cancel()
+		case <-ctx.Done():
+			signal.Stop(sigChan)
+		}
+	}()
+	return ctx, cancel
+}
+
 func main() {
 	if err := kubespawnCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -0,0 +1,119 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+)
+
+var (
+	kubeconfigCmd = &cobra.Command{
+		Use:   "kubeconfig",
+		Short: "Print the admin kubeconfig of a cluster or merge it into a user's kubeconfig",
+		Long: `Print the admin kubeconfig of a cluster or merge it into a user's kubeconfig
+
+With --merge, a context named "kube-spawn-<cluster name>" is written to
+~/.kube/config of the user given with --user. When run through sudo, the
+invoking user is the default. The context is removed again when the
+cluster is destroyed.`,
+		Example: `
+# Add the default cluster to your ~/.kube/config
+$ sudo ./kube-spawn kubeconfig --merge
+$ kubectl --context kube-spawn-default get nodes`,
+		Run:         runKubeconfig,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(kubeconfigCmd)
+
+	kubeconfigCmd.Flags().Bool("merge", false, "Merge the cluster credentials into ~/.kube/config instead of printing them")
+	kubeconfigCmd.Flags().String("user", "", "User whose kubeconfig to merge into (default: $SUDO_USER or the current user)")
+}
+
+func runKubeconfig(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command kubeconfig doesn't take arguments, got: %v", args)
+	}
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	if !viper.GetBool("merge") {
+		content, err := ioutil.ReadFile(kluster.AdminKubeconfigPath())
+		if err != nil {
+			log.Fatalf("Failed to read admin kubeconfig: %v", err)
+		}
+		if _, err := os.Stdout.Write(content); err != nil {
+			log.Fatalf("Failed to print admin kubeconfig: %v", err)
+		}
+		return
+	}
+
+	u, err := kubeconfigUser(viper.GetString("user"))
+	if err != nil {
+		log.Fatalf("Failed to look up user: %v", err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		log.Fatalf("Failed to parse uid of user %q: %v", u.Username, err)
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		log.Fatalf("Failed to parse gid of user %q: %v", u.Username, err)
+	}
+
+	kubeconfigPath := path.Join(u.HomeDir, ".kube", "config")
+
+	clusterLock := lockCluster(kluster)
+	defer clusterLock.Release()
+
+	if err := kluster.MergeKubeconfig(kubeconfigPath, uid, gid); err != nil {
+		log.Fatalf("Failed to merge kubeconfig: %v", err)
+	}
+	log.Printf("Context %q added to %s", kluster.KubeconfigContextName(), kubeconfigPath)
+	log.Printf("Use it with:\n\n\tkubectl config use-context %s\n\n", kluster.KubeconfigContextName())
+}
+
+// kubeconfigUser returns the named user or, if name is empty, the user
+// who invoked sudo or the current user
+func kubeconfigUser(name string) (*user.User, error) {
+	if name == "" {
+		name = os.Getenv("SUDO_USER")
+	}
+	if name == "" {
+		return user.Current()
+	}
+	return user.Lookup(name)
+}
@@ -18,13 +18,14 @@ package main
 
 import (
 	"fmt"
-	"io/ioutil"
 	"log"
 	"os"
-	"path"
+	"text/tabwriter"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils"
 )
 
 var (
@@ -37,6 +38,8 @@ var (
 
 func init() {
 	kubespawnCmd.AddCommand(listCmd)
+
+	listCmd.Flags().Bool("size", false, "Show the disk space each cluster uses (walks all cluster files, which can take a while)")
 }
 
 func runList(cmd *cobra.Command, args []string) {
@@ -44,19 +47,35 @@ func runList(cmd *cobra.Command, args []string) {
 		log.Fatalf("Command list doesn't take arguments, got: %v", args)
 	}
 
-	clusterDir := path.Join(viper.GetString("dir"), "clusters/")
-
-	entries, err := ioutil.ReadDir(clusterDir)
-	if err != nil && !os.IsNotExist(err) {
+	names, err := clusterNames()
+	if err != nil {
 		log.Fatalf("Failed to read cluster directory: %v", err)
 	}
 
-	if len(entries) == 0 {
+	if len(names) == 0 {
 		log.Printf("No clusters yet")
 	} else {
 		fmt.Println("Available clusters:")
-		for _, entry := range entries {
-			fmt.Printf(" %s\n", entry.Name())
+		if !viper.GetBool("size") {
+			for _, name := range names {
+				fmt.Printf(" %s\n", name)
+			}
+			return
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		var usageErr error
+		for _, name := range names {
+			size := "?"
+			if usage, err := clusterByName(name).DiskUsage(); err != nil {
+				usageErr = err
+			} else {
+				size = utils.FormatBytes(usage.Total())
+			}
+			fmt.Fprintf(w, " %s\t%s\n", name, size)
+		}
+		w.Flush()
+		if usageErr != nil {
+			log.Printf("Failed to determine disk usage (run as root?): %v", usageErr)
 		}
 	}
 }
@@ -0,0 +1,134 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+)
+
+var (
+	logsCmd = &cobra.Command{
+		Use:   "logs NODE",
+		Short: "Show the logs of a node",
+		Long: `Show the logs of a node
+
+By default, the journal of the node is shown. With --unit, only the
+messages of the given systemd unit (e.g. kubelet, docker or containerd)
+are shown.
+
+With --bootstrap, the output of the bootstrap script and kubeadm captured
+during 'kube-spawn start' is shown instead. The captured logs are kept in
+the cluster directory and are also available for nodes which were removed
+after a failed start.`,
+		Example: `
+# Follow the kubelet logs of the master node
+$ sudo ./kube-spawn logs master --unit kubelet -f
+
+# Show why bootstrapping the first worker failed
+$ sudo ./kube-spawn logs worker-1 --bootstrap`,
+		Run:         runLogs,
+		Annotations: requiresRoot,
+	}
+	flagLogsUnit      string
+	flagLogsFollow    bool
+	flagLogsBootstrap bool
+)
+
+func init() {
+	kubespawnCmd.AddCommand(logsCmd)
+	logsCmd.Flags().StringVarP(&flagLogsUnit, "unit", "u", "", "Show only the logs of the given systemd unit")
+	logsCmd.Flags().BoolVarP(&flagLogsFollow, "follow", "f", false, "Follow the journal")
+	logsCmd.Flags().BoolVar(&flagLogsBootstrap, "bootstrap", false, "Show the captured output of the bootstrap script and kubeadm")
+}
+
+func runLogs(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Command logs takes exactly one node argument, got: %v", args)
+	}
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	if flagLogsBootstrap {
+		printBootstrapLogs(kluster, args[0])
+		return
+	}
+
+	machine, err := kluster.ResolveMachine(args[0])
+	if err != nil {
+		log.Fatalf("Failed to find node: %v", err)
+	}
+
+	var journalArgs []string
+	if flagLogsUnit != "" {
+		journalArgs = append(journalArgs, "--unit", flagLogsUnit)
+	}
+	if flagLogsFollow {
+		journalArgs = append(journalArgs, "--follow")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	if err := machinectl.Journal(ctx, os.Stdout, machine.Name, journalArgs...); err != nil && ctx.Err() == nil {
+		log.Fatalf("Failed to show logs of %s: %v", machine.Name, err)
+	}
+}
+
+func printBootstrapLogs(kluster *cluster.Cluster, node string) {
+	// Look for a running machine first and fall back to the machines
+	// logs were captured for, as the machines of a failed start are
+	// usually removed
+	var machineName string
+	if machine, err := kluster.ResolveMachine(node); err == nil {
+		machineName = machine.Name
+	} else if machineName, err = kluster.ResolveLoggedMachine(node); err != nil {
+		log.Fatalf("Failed to find node: %v", err)
+	}
+
+	logs, err := kluster.MachineLogs(machineName)
+	if err != nil {
+		log.Fatalf("Failed to list captured logs: %v", err)
+	}
+	for _, logPath := range logs {
+		fmt.Printf("==> %s <==\n", logPath)
+		f, err := os.Open(logPath)
+		if err != nil {
+			log.Fatalf("Failed to open %q: %v", logPath, err)
+		}
+		if _, err := io.Copy(os.Stdout, f); err != nil {
+			log.Fatalf("Failed to read %q: %v", logPath, err)
+		}
+		f.Close()
+	}
+}
@@ -0,0 +1,291 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/lock"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+var (
+	poolCmd = &cobra.Command{
+		Use:   "pool",
+		Short: "Manage the machine pool in /var/lib/machines",
+		Long: `Manage the machine pool in /var/lib/machines
+
+On older systemd versions, or if /var/lib/machines isn't a separate
+filesystem, systemd-machined keeps the images of all machines in the
+btrfs filesystem in the loopback file /var/lib/machines.raw. kube-spawn
+doesn't resize it on its own, use "pool grow" or pass --grow-pool to start.`,
+	}
+
+	poolStatusCmd = &cobra.Command{
+		Use:         "status",
+		Short:       "Show the size and usage of the machine pool per cluster and image",
+		Run:         runPoolStatus,
+		Annotations: requiresRoot,
+	}
+
+	poolGrowCmd = &cobra.Command{
+		Use:   "grow SIZE",
+		Short: "Grow the machine pool to SIZE, or by SIZE if prefixed with +",
+		Long: `Grow the machine pool to SIZE, or by SIZE if prefixed with +
+
+SIZE is given in bytes or with one of the suffixes K, M, G or T. If the
+pool is in use, all machines have to be stopped first.`,
+		Example: `
+# Grow the pool to 20 GiB
+$ sudo ./kube-spawn pool grow 20G
+
+# Add 5 GiB to the pool
+$ sudo ./kube-spawn pool grow +5G`,
+		Run:         runPoolGrow,
+		Annotations: requiresRoot,
+	}
+
+	poolShrinkCmd = &cobra.Command{
+		Use:   "shrink SIZE",
+		Short: "Shrink the machine pool to SIZE",
+		Long: `Shrink the machine pool to SIZE
+
+SIZE is given in bytes or with one of the suffixes K, M, G or T. All
+machines have to be stopped first, and the pool keeps some free space.`,
+		Example: `
+# Shrink the pool to 10 GiB
+$ sudo ./kube-spawn pool shrink 10G`,
+		Run:         runPoolShrink,
+		Annotations: requiresRoot,
+	}
+
+	poolCheckCmd = &cobra.Command{
+		Use:   "check",
+		Short: "Check that the machine pool is usable and large enough to start a cluster",
+		Long: `Check that the machine pool is usable and large enough to start a cluster
+
+Nothing is changed. Exits with status 1 if a check failed.`,
+		Run:         runPoolCheck,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(poolCmd)
+	poolCmd.AddCommand(poolStatusCmd)
+	poolCmd.AddCommand(poolGrowCmd)
+	poolCmd.AddCommand(poolShrinkCmd)
+	poolCmd.AddCommand(poolCheckCmd)
+
+	poolCheckCmd.Flags().IntP("nodes", "n", 3, "Number of nodes to check for")
+	poolCheckCmd.Flags().String("base-image", bootstrap.DefaultBaseImage, "Base image to check for")
+}
+
+func runPoolStatus(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command status doesn't take arguments, got: %v", args)
+	}
+
+	usage, err := bootstrap.GetPoolUsage(true)
+	if err != nil {
+		log.Fatalf("Failed to determine pool usage: %v", err)
+	}
+
+	if usage.ImageExists {
+		mounted := "mounted"
+		if !usage.Mounted {
+			mounted = "not mounted"
+		}
+		fmt.Printf("Pool:      /var/lib/machines.raw (%s, %s allocated)\n", mounted, utils.FormatBytes(usage.ImageAllocated))
+	} else {
+		fmt.Printf("Pool:      /var/lib/machines (directory)\n")
+	}
+	fmt.Printf("Size:      %s\n", utils.FormatBytes(int64(usage.Size)))
+	fmt.Printf("Used:      %s\n", utils.FormatBytes(int64(usage.Used())))
+	fmt.Printf("Free:      %s\n", utils.FormatBytes(int64(usage.Free)))
+	fmt.Printf("Host free: %s\n", utils.FormatBytes(int64(usage.HostFree)))
+
+	clusters, err := clusterNames()
+	if err != nil {
+		log.Fatalf("Failed to list clusters: %v", err)
+	}
+	clusterUsage := make(map[string]int64)
+	clusterImages := make(map[string]int)
+	for _, image := range usage.Images {
+		name := imageClusterName(image.Name, clusters)
+		clusterUsage[name] += image.Usage
+		clusterImages[name]++
+	}
+
+	fmt.Println()
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "CLUSTER\tIMAGES\tUSAGE")
+	var names []string
+	for name := range clusterUsage {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		displayName := name
+		if name == "" {
+			displayName = "-"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\n", displayName, clusterImages[name], utils.FormatBytes(clusterUsage[name]))
+	}
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tCLUSTER\tUSAGE")
+	for _, image := range usage.Images {
+		name := imageClusterName(image.Name, clusters)
+		if name == "" {
+			name = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", image.Name, name, utils.FormatBytes(image.Usage))
+	}
+	w.Flush()
+
+	fmt.Println("\nImages cloned from the same base image share space on btrfs, the usage of every image includes the shared data.")
+}
+
+// clusterNames returns the names of all clusters in the asset directory
+func clusterNames() ([]string, error) {
+	return cluster.ListNames(path.Join(viper.GetString("dir"), "clusters"))
+}
+
+// imageClusterName returns the cluster the machine image belongs to, or
+// an empty string for images of no cluster, e.g. base images. As cluster
+// names can contain dashes, the longest matching name wins.
+func imageClusterName(imageName string, clusters []string) string {
+	var match string
+	for _, name := range clusters {
+		re := regexp.MustCompile(fmt.Sprintf("^kube-spawn-%s-(master|worker)-", regexp.QuoteMeta(name)))
+		if re.MatchString(imageName) && len(name) > len(match) {
+			match = name
+		}
+	}
+	return match
+}
+
+func runPoolGrow(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Command grow takes exactly one size argument, got: %v", args)
+	}
+	resizePool(args[0], true, bootstrap.GrowPool)
+}
+
+func runPoolShrink(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Command shrink takes exactly one size argument, got: %v", args)
+	}
+	resizePool(args[0], false, bootstrap.ShrinkPool)
+}
+
+// resizePool resizes the pool to the size given by arg, which is added
+// to the current size if prefixed with + and relative is set
+func resizePool(arg string, relative bool, resize func(size int64) error) {
+	sizeArg := arg
+	if relative {
+		sizeArg = strings.TrimPrefix(arg, "+")
+	}
+	size, err := parseSize(sizeArg)
+	if err != nil {
+		log.Fatalf("Invalid size %q: %v", arg, err)
+	}
+
+	// Other kube-spawn processes must not use the pool meanwhile
+	hostLock, err := lock.AcquireHost(viper.GetDuration("wait-lock"))
+	if err != nil {
+		log.Fatalf("Failed to lock host: %v", err)
+	}
+	defer hostLock.Release()
+
+	usage, err := bootstrap.GetPoolUsage(false)
+	if err != nil {
+		log.Fatalf("Failed to determine pool usage: %v", err)
+	}
+	if sizeArg != arg {
+		size += int64(usage.Size)
+	}
+
+	log.Printf("Resizing machine pool from %s to %s ...", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(size))
+	if err := resize(size); err != nil {
+		log.Fatalf("Failed to resize machine pool: %v", err)
+	}
+	if usage, err = bootstrap.GetPoolUsage(false); err != nil {
+		log.Fatalf("Failed to determine pool usage: %v", err)
+	}
+	log.Printf("Machine pool is %s now, %s free", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(int64(usage.Free)))
+}
+
+// parseSize parses a size in bytes with an optional binary unit suffix,
+// e.g. 512M or 20G
+func parseSize(s string) (int64, error) {
+	units := map[string]uint{"K": 10, "M": 20, "G": 30, "T": 40}
+	s = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(s), "B"), "I")
+	var shift uint
+	if len(s) > 0 {
+		if unitShift, ok := units[s[len(s)-1:]]; ok {
+			shift = unitShift
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number of bytes with an optional K, M, G or T suffix")
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("size must be positive")
+	}
+	if n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("size is too large")
+	}
+	return n << shift, nil
+}
+
+func runPoolCheck(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command check doesn't take arguments, got: %v", args)
+	}
+
+	checks := bootstrap.CheckPool(viper.GetString("base-image"), viper.GetInt("nodes"))
+	printChecks(checks)
+	failed := false
+	for _, check := range checks {
+		if check.Status == bootstrap.CheckFail {
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
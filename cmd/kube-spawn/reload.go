@@ -0,0 +1,173 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"log"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+)
+
+// reloadDebounce is how long to wait after the last change of a binary
+// before reloading it, builds usually write the binaries in several steps
+const reloadDebounce = 2 * time.Second
+
+var (
+	reloadCmd = &cobra.Command{
+		Use:   "reload",
+		Short: "Replace Kubernetes binaries of a running cluster with locally built ones",
+		Long: `Replace Kubernetes binaries of a running cluster with locally built ones
+
+The binaries are copied from the "_output" directory of the Kubernetes
+source dir into the cluster and the affected units are restarted on every
+node. With --watch, this is done again every time a binary changes.`,
+		Example: `
+# Replace the kubelet after a rebuild
+$ sudo ./kube-spawn reload --kubernetes-source-dir $GOPATH/src/k8s.io/kubernetes --component kubelet
+
+# Keep reloading all binaries whenever they are rebuilt
+$ sudo ./kube-spawn reload --kubernetes-source-dir $GOPATH/src/k8s.io/kubernetes --watch`,
+		Run:         runReload,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(reloadCmd)
+
+	reloadCmd.Flags().String("kubernetes-source-dir", "", "Path to directory with Kubernetes sources")
+	reloadCmd.Flags().StringSlice("component", cluster.ReloadComponents(), "Binaries to reload")
+	reloadCmd.Flags().Bool("watch", false, "Keep running and reload binaries whenever they change")
+}
+
+func runReload(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command reload doesn't take arguments, got: %v", args)
+	}
+	if viper.GetString("kubernetes-source-dir") == "" {
+		log.Fatalf("No Kubernetes source dir given, use --kubernetes-source-dir")
+	}
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	reloadSettings := &cluster.ReloadSettings{
+		KubernetesSourceDir: viper.GetString("kubernetes-source-dir"),
+		Components:          viper.GetStringSlice("component"),
+	}
+	if err := doReload(ctx, kluster, reloadSettings); err != nil {
+		log.Fatalf("Failed to reload: %v", err)
+	}
+
+	if viper.GetBool("watch") {
+		watchReload(ctx, kluster, reloadSettings)
+	}
+}
+
+// doReload takes the cluster lock only for the duration of the reload,
+// so that other commands can use the cluster while watching
+func doReload(ctx context.Context, kluster *cluster.Cluster, reloadSettings *cluster.ReloadSettings) error {
+	clusterLock, err := kluster.Lock(viper.GetDuration("wait-lock"))
+	if err != nil {
+		return err
+	}
+	defer clusterLock.Release()
+
+	return kluster.Reload(ctx, reloadSettings)
+}
+
+// watchReload reloads the components whenever their binary changes until
+// the context is cancelled. Failed reloads are logged, not fatal, as the
+// next build might fix them.
+func watchReload(ctx context.Context, kluster *cluster.Cluster, reloadSettings *cluster.ReloadSettings) {
+	binaryDir, err := cluster.KubernetesSourceBinaryDir(reloadSettings.KubernetesSourceDir)
+	if err != nil {
+		log.Fatalf("Failed to find binaries: %v", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Fatalf("Failed to create file watcher: %v", err)
+	}
+	defer watcher.Close()
+	if err := watcher.Add(binaryDir); err != nil {
+		log.Fatalf("Failed to watch %q: %v", binaryDir, err)
+	}
+
+	watched := make(map[string]bool)
+	for _, component := range reloadSettings.Components {
+		watched[component] = true
+	}
+
+	log.Printf("Watching %s for changes, press Ctrl-C to stop", binaryDir)
+
+	changed := make(map[string]bool)
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Base(event.Name)
+			if !watched[name] || event.Op&(fsnotify.Create|fsnotify.Write) == 0 {
+				continue
+			}
+			changed[name] = true
+			debounce.Reset(reloadDebounce)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Error watching %q: %v", binaryDir, err)
+		case <-debounce.C:
+			var components []string
+			for component := range changed {
+				components = append(components, component)
+			}
+			sort.Strings(components)
+			changed = make(map[string]bool)
+
+			settings := *reloadSettings
+			settings.Components = components
+			if err := doReload(ctx, kluster, &settings); err != nil {
+				log.Printf("Failed to reload: %v", err)
+			}
+		}
+	}
+}
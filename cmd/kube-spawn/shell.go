@@ -0,0 +1,79 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"os"
+	"path"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+)
+
+var (
+	shellCmd = &cobra.Command{
+		Use:   "shell NODE",
+		Short: "Open a shell on a node of a running cluster",
+		Long: `Open a shell on a node of a running cluster
+
+NODE can be the full or short machine name (e.g. worker-fpllng), "master"
+for the master node or "worker-N" for the N-th worker node.`,
+		Example: `
+# Open a shell on the master node
+$ sudo ./kube-spawn shell master
+
+# Open a shell on the second worker node
+$ sudo ./kube-spawn shell worker-2`,
+		Run:         runShell,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(shellCmd)
+}
+
+func runShell(cmd *cobra.Command, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Command shell takes exactly one node argument, got: %v", args)
+	}
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	machine, err := kluster.ResolveMachine(args[0])
+	if err != nil {
+		log.Fatalf("Failed to find node: %v", err)
+	}
+
+	if err := machinectl.Shell(machine.Name); err != nil {
+		if _, ok := err.(*machinectl.CommandError); !ok {
+			log.Printf("Failed to open shell on %s: %v", machine.Name, err)
+		}
+		os.Exit(machinectl.ExitCode(err))
+	}
+}
@@ -17,20 +17,33 @@ limitations under the License.
 package main
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"path"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
 	"github.com/kinvolk/kube-spawn/pkg/cluster"
+	"github.com/kinvolk/kube-spawn/pkg/storage"
 )
 
 var (
 	startCmd = &cobra.Command{
 		Use:   "start",
 		Short: "Start a cluster that was created with 'kube-spawn create' before",
-		Run:   runStart,
+		Example: `
+# Start a cluster on Debian nodes
+$ sudo ./kube-spawn start --base-image debian --insecure-skip-image-verify
+
+# Start a master, two workers and two workers of node group "old"
+$ sudo ./kube-spawn start --nodes 3 --node-group-size old=2`,
+		Run:         runStart,
+		Annotations: requiresRoot,
 	}
 )
 
@@ -40,7 +53,15 @@ func init() {
 	startCmd.Flags().IntP("nodes", "n", 3, "Number of nodes to start")
 	startCmd.Flags().String("cni-plugin-dir", "/opt/cni/bin", "Path to directory with CNI plugins")
 	startCmd.Flags().String("cni-plugin", "weave", "CNI plugin (weave, flannel, calico, canal)")
+	startCmd.Flags().String("base-image", bootstrap.DefaultBaseImage, baseImageUsage())
+	startCmd.Flags().Bool("insecure-skip-image-verify", false, "Don't verify the signature of the downloaded base image")
+	startCmd.Flags().String("image-signing-key", "", "OpenPGP public key to verify the base image with (default for Flatcar: "+bootstrap.DefaultFlatcarSigningKeyPath+", which has to be installed first)")
 	startCmd.Flags().String("flatcar-channel", "alpha", "Channel for Flatcar Linux (alpha, beta, stable)")
+	startCmd.Flags().Duration("wait", 0, "Wait up to the given duration (e.g. 5m) for all nodes and kube-system pods to become ready")
+	startCmd.Flags().Bool("keep-on-failure", false, "Don't remove the machines of a failed start (for debugging)")
+	startCmd.Flags().Bool("grow-pool", false, "Grow the machine pool if it is too small for the cluster")
+	startCmd.Flags().String("storage-driver", storage.DriverAuto, fmt.Sprintf("How to create the node images from the base image (%s); auto uses btrfs if /var/lib/machines is on btrfs, overlay otherwise", strings.Join(storage.Drivers(), ", ")))
+	startCmd.Flags().StringSlice("node-group-size", nil, "Number of additional workers to start in a node group as NAME=N (can be given multiple times)")
 }
 
 func runStart(cmd *cobra.Command, args []string) {
@@ -48,28 +69,71 @@ func runStart(cmd *cobra.Command, args []string) {
 		log.Fatalf("Command start doesn't take arguments, got: %v", args)
 	}
 
-	doStart()
+	ctx, cancel := signalContext()
+	defer cancel()
 
+	kluster := clusterByName(viper.GetString("cluster-name"))
+	clusterLock := lockCluster(kluster)
+	defer clusterLock.Release()
+
+	doStart(ctx, kluster)
 }
 
-func doStart() {
+// doStart starts the cluster, the caller has to hold the cluster lock
+func doStart(ctx context.Context, kluster *cluster.Cluster) {
+	configureArch()
+	configureDownloads()
+
 	kubespawnDir := viper.GetString("dir")
 	clusterName := viper.GetString("cluster-name")
-	numberNodes := viper.GetInt("nodes")
-	cniPluginDir := viper.GetString("cni-plugin-dir")
-	cniPlugin := viper.GetString("cni-plugin")
-	flatcarChannel := viper.GetString("flatcar-channel")
 
-	kluster, err := cluster.New(path.Join(kubespawnDir, "clusters", clusterName), clusterName)
+	nodeGroupSizes, err := parseNodeGroupSizes(viper.GetStringSlice("node-group-size"))
 	if err != nil {
-		log.Fatalf("Failed to create cluster object: %v", err)
+		log.Fatalf("Invalid node group size: %v", err)
+	}
+
+	startSettings := &cluster.StartSettings{
+		Nodes:          viper.GetInt("nodes"),
+		CNIPluginDir:   viper.GetString("cni-plugin-dir"),
+		CNIPlugin:      viper.GetString("cni-plugin"),
+		BaseImage:      viper.GetString("base-image"),
+		FlatcarChannel: viper.GetString("flatcar-channel"),
+		WaitTimeout:    viper.GetDuration("wait"),
+		KeepOnFailure:  viper.GetBool("keep-on-failure"),
+		GrowPool:       viper.GetBool("grow-pool"),
+		StorageDriver:  viper.GetString("storage-driver"),
+		LockTimeout:    viper.GetDuration("wait-lock"),
+		NodeGroupSizes: nodeGroupSizes,
+		ImageVerification: bootstrap.ImageVerification{
+			SkipVerify:     viper.GetBool("insecure-skip-image-verify"),
+			SigningKeyPath: viper.GetString("image-signing-key"),
+			DownloadDir:    path.Join(kubespawnDir, "cache", "images"),
+		},
 	}
 
-	if err := kluster.Start(numberNodes, cniPluginDir, cniPlugin, flatcarChannel); err != nil {
+	if err := kluster.Start(ctx, startSettings); err != nil {
 		log.Fatalf("Failed to start cluster: %v", err)
 	}
 
 	log.Printf("Cluster %q initialized", clusterName)
 	log.Println("Export $KUBECONFIG as follows for kubectl:")
 	log.Printf("\n\texport KUBECONFIG=%s\n\n", kluster.AdminKubeconfigPath())
+	log.Println("or add the cluster to your ~/.kube/config with `kube-spawn kubeconfig --merge`")
+}
+
+// parseNodeGroupSizes parses node group sizes given as NAME=N
+func parseNodeGroupSizes(values []string) (map[string]int, error) {
+	nodeGroupSizes := make(map[string]int)
+	for _, value := range values {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("expected NAME=N, got %q", value)
+		}
+		size, err := strconv.Atoi(parts[1])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("expected NAME=N with N >= 0, got %q", value)
+		}
+		nodeGroupSizes[parts[0]] = size
+	}
+	return nodeGroupSizes, nil
 }
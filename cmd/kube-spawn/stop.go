@@ -28,9 +28,10 @@ import (
 
 var (
 	stopCmd = &cobra.Command{
-		Use:   "stop",
-		Short: "Stop a running cluster",
-		Run:   runStop,
+		Use:         "stop",
+		Short:       "Stop a running cluster",
+		Run:         runStop,
+		Annotations: requiresRoot,
 	}
 	flagForce bool
 )
@@ -54,6 +55,9 @@ func runStop(cmd *cobra.Command, args []string) {
 		log.Fatalf("Failed to create cluster object: %v", err)
 	}
 
+	clusterLock := lockCluster(kluster)
+	defer clusterLock.Release()
+
 	log.Printf("Stopping cluster %s ...", clusterName)
 
 	if err := kluster.Stop(); err != nil {
@@ -0,0 +1,92 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+)
+
+var (
+	supportBundleCmd = &cobra.Command{
+		Use:   "support-bundle",
+		Short: "Collect diagnostics of a cluster into a tarball",
+		Long: `Collect diagnostics of a cluster into a tarball
+
+The bundle contains host state (iptables rules, CNI configuration,
+machined machines and images, storage pool usage), the generated cluster
+configuration, the captured bootstrap and kubeadm logs, the journal and
+kubelet configuration of every node and 'kubectl get' dumps.
+
+Private keys, tokens and kubeconfig credentials are redacted, but please
+check the bundle before sharing it.`,
+		Run:         runSupportBundle,
+		Annotations: requiresRoot,
+	}
+	flagSupportBundleOutput string
+)
+
+func init() {
+	kubespawnCmd.AddCommand(supportBundleCmd)
+	supportBundleCmd.Flags().StringVarP(&flagSupportBundleOutput, "output", "o", "", "Path of the tarball (default \"kube-spawn-<cluster>-support-<time>.tar.gz\")")
+}
+
+func runSupportBundle(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command support-bundle doesn't take arguments, got: %v", args)
+	}
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	output := flagSupportBundleOutput
+	if output == "" {
+		output = fmt.Sprintf("kube-spawn-%s-support-%s.tar.gz", clusterName, time.Now().Format("20060102-150405"))
+	}
+
+	f, err := os.Create(output)
+	if err != nil {
+		log.Fatalf("Failed to create %q: %v", output, err)
+	}
+	defer f.Close()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	log.Printf("Collecting diagnostics of cluster %s ...", clusterName)
+
+	if err := kluster.WriteSupportBundle(ctx, f); err != nil {
+		os.Remove(output)
+		log.Fatalf("Failed to write support bundle: %v", err)
+	}
+
+	log.Printf("Support bundle written to %s", output)
+}
@@ -17,9 +17,14 @@ limitations under the License.
 package main
 
 import (
+	"fmt"
 	"log"
+	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/storage"
 )
 
 var (
@@ -29,7 +34,8 @@ var (
 		Example: `
 # Create and start a Kubernetes v1.10.0 cluster with 4 nodes (master + 3 worker)
 sudo ./kube-spawn up --kubernetes-version v1.10.0 --nodes 4`,
-		Run: runUp,
+		Run:         runUp,
+		Annotations: requiresRoot,
 	}
 )
 
@@ -41,13 +47,23 @@ func init() {
 	upCmd.Flags().String("container-runtime", "docker", "Runtime to use for the cluster (can be docker or rkt)")
 	upCmd.Flags().String("kubernetes-version", "v1.12.3", "Kubernetes version to install")
 	upCmd.Flags().String("kubernetes-source-dir", "", "Path to directory with Kubernetes sources")
+	upCmd.Flags().Bool("build", false, "Build the Kubernetes binaries (and the hyperkube image, if given) in the Kubernetes source dir first")
 	upCmd.Flags().String("hyperkube-image", "", "Kubernetes hyperkube image to use (if unset, upstream k8s is installed)")
 	upCmd.Flags().String("cni-plugin-dir", "/opt/cni/bin", "Path to directory with CNI plugins")
 	upCmd.Flags().String("cni-plugin", "weave", "CNI plugin to use (weave, flannel, calico, canal)")
 	upCmd.Flags().String("rkt-binary-path", "/usr/local/bin/rkt", "Path to rkt binary")
 	upCmd.Flags().String("rkt-stage1-image-path", "/usr/local/bin/stage1-coreos.aci", "Path to rkt stage1-coreos.aci image")
 	upCmd.Flags().String("rktlet-binary-path", "/usr/local/bin/rktlet", "Path to rktlet binary")
+	upCmd.Flags().String("base-image", bootstrap.DefaultBaseImage, baseImageUsage())
+	upCmd.Flags().Bool("insecure-skip-image-verify", false, "Don't verify the signature of the downloaded base image")
+	upCmd.Flags().String("image-signing-key", "", "OpenPGP public key to verify the base image with (default for Flatcar: "+bootstrap.DefaultFlatcarSigningKeyPath+", which has to be installed first)")
 	upCmd.Flags().IntP("nodes", "n", 3, "Number of nodes to start")
+	upCmd.Flags().Duration("wait", 0, "Wait up to the given duration (e.g. 5m) for all nodes and kube-system pods to become ready")
+	upCmd.Flags().Bool("keep-on-failure", false, "Don't remove the machines of a failed start (for debugging)")
+	upCmd.Flags().Bool("grow-pool", false, "Grow the machine pool if it is too small for the cluster")
+	upCmd.Flags().String("storage-driver", storage.DriverAuto, fmt.Sprintf("How to create the node images from the base image (%s); auto uses btrfs if /var/lib/machines is on btrfs, overlay otherwise", strings.Join(storage.Drivers(), ", ")))
+	upCmd.Flags().StringSlice("node-group", nil, "Node group with its own Kubernetes version as NAME=VERSION, e.g. old=v1.11.8 (can be given multiple times)")
+	upCmd.Flags().StringSlice("node-group-size", nil, "Number of additional workers to start in a node group as NAME=N (can be given multiple times)")
 }
 
 func runUp(cmd *cobra.Command, args []string) {
@@ -55,6 +71,14 @@ func runUp(cmd *cobra.Command, args []string) {
 		log.Fatalf("Command up doesn't take arguments, got: %v", args)
 	}
 
-	doCreate()
-	doStart()
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	// hold the lock from create to start, so that no other kube-spawn
+	// process can destroy or modify the cluster in between
+	kluster, clusterLock := lockNewCluster()
+	defer clusterLock.Release()
+
+	doCreate(ctx, kluster)
+	doStart(ctx, kluster)
 }
@@ -0,0 +1,94 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"log"
+	"path"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/kinvolk/kube-spawn/pkg/cache"
+	"github.com/kinvolk/kube-spawn/pkg/cluster"
+)
+
+var (
+	upgradeCmd = &cobra.Command{
+		Use:   "upgrade",
+		Short: "Upgrade a running cluster to a new Kubernetes version",
+		Long: `Upgrade a running cluster to a new Kubernetes version
+
+The master is upgraded with "kubeadm upgrade apply", then the workers are
+drained, upgraded and uncordoned one at a time. Nodes started later on
+use the new version as well.`,
+		Example: `
+# Upgrade the default cluster to Kubernetes v1.13.4
+$ sudo ./kube-spawn upgrade --kubernetes-version v1.13.4`,
+		Run:         runUpgrade,
+		Annotations: requiresRoot,
+	}
+)
+
+func init() {
+	kubespawnCmd.AddCommand(upgradeCmd)
+
+	upgradeCmd.Flags().String("kubernetes-version", "", "Kubernetes version to upgrade to")
+	upgradeCmd.Flags().Duration("drain-timeout", 5*time.Minute, "How long to wait for a worker to be drained")
+}
+
+func runUpgrade(cmd *cobra.Command, args []string) {
+	if len(args) > 0 {
+		log.Fatalf("Command upgrade doesn't take arguments, got: %v", args)
+	}
+	if viper.GetString("kubernetes-version") == "" {
+		log.Fatalf("No Kubernetes version given, use --kubernetes-version")
+	}
+	configureArch()
+	configureDownloads()
+
+	ctx, cancel := signalContext()
+	defer cancel()
+
+	kubespawnDir := viper.GetString("dir")
+	clusterName := viper.GetString("cluster-name")
+	clusterDir := path.Join(kubespawnDir, "clusters", clusterName)
+
+	kluster, err := cluster.New(clusterDir, clusterName)
+	if err != nil {
+		log.Fatalf("Failed to create cluster object: %v", err)
+	}
+
+	clusterLock := lockCluster(kluster)
+	defer clusterLock.Release()
+
+	clusterCache, err := cache.New(path.Join(kubespawnDir, "cache"))
+	if err != nil {
+		log.Fatalf("Failed to create cache object: %v", err)
+	}
+
+	upgradeSettings := &cluster.UpgradeSettings{
+		KubernetesVersion: viper.GetString("kubernetes-version"),
+		DrainTimeout:      viper.GetDuration("drain-timeout"),
+	}
+	if err := kluster.Upgrade(ctx, upgradeSettings, clusterCache); err != nil {
+		log.Fatalf("Failed to upgrade cluster: %v", err)
+	}
+
+	log.Printf("Cluster %q upgraded to %s", clusterName, upgradeSettings.KubernetesVersion)
+}
@@ -0,0 +1,69 @@
+package bootstrap
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// archMachines maps the supported architectures, named like in Go and
+// Kubernetes, to their kernel names as shown by `uname -m`
+var archMachines = map[string]string{
+	"amd64": "x86_64",
+	"arm64": "aarch64",
+}
+
+var arch = "amd64"
+
+// SupportedArchs returns the architectures kube-spawn can download
+// artifacts for
+func SupportedArchs() []string {
+	var archs []string
+	for a := range archMachines {
+		archs = append(archs, a)
+	}
+	sort.Strings(archs)
+	return archs
+}
+
+// HostArch returns the architecture of the running kernel
+func HostArch() (string, error) {
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err != nil {
+		return "", errors.Wrap(err, "uname failed")
+	}
+	machine := string(uname.Machine[:])
+	if i := strings.IndexByte(machine, 0); i >= 0 {
+		machine = machine[:i]
+	}
+	for a, m := range archMachines {
+		if m == machine {
+			return a, nil
+		}
+	}
+	return "", errors.Errorf("unsupported host architecture %q (supported: %s)", machine, strings.Join(SupportedArchs(), ", "))
+}
+
+// SetArch sets the architecture artifacts are downloaded for. An empty
+// arch means the architecture of the host.
+func SetArch(a string) error {
+	if a == "" {
+		hostArch, err := HostArch()
+		if err != nil {
+			return err
+		}
+		a = hostArch
+	}
+	if _, ok := archMachines[a]; !ok {
+		return errors.Errorf("unsupported architecture %q (supported: %s)", a, strings.Join(SupportedArchs(), ", "))
+	}
+	arch = a
+	return nil
+}
+
+// Arch returns the architecture artifacts are downloaded for
+func Arch() string {
+	return arch
+}
@@ -0,0 +1,429 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+)
+
+const (
+	// DefaultBaseImage is the name of the base image used if none is
+	// given
+	DefaultBaseImage = "flatcar"
+
+	flatcarImageFile = "flatcar_developer_container.bin.bz2"
+
+	BaseImageTypeRaw = "raw"
+	BaseImageTypeTar = "tar"
+	BaseImageTypeFs  = "fs"
+)
+
+// BaseImage describes a machine image the nodes are cloned from
+type BaseImage struct {
+	// Name is the name of the image in the machined image pool
+	Name string
+	// URL to pull the image from. It can contain the placeholders of
+	// mirror URLs, see Mirrors.
+	URL string
+	// Path of a local file or directory to import the image from
+	// instead of pulling it from URL
+	Path string
+	// Type is the image type, one of BaseImageTypeRaw, BaseImageTypeTar
+	// and BaseImageTypeFs (only for Path)
+	Type string
+	// MinVersion is the minimum OS version of the image, as shown in
+	// the `OS:` line of `machinectl image-status`. Empty means any
+	// version is fine.
+	MinVersion string
+	// SignatureURL is the URL of the detached OpenPGP signature of the
+	// image, with a `$CHANNEL` for the release channel like URL. Images
+	// without a signature can only be used with verification disabled.
+	SignatureURL string
+	// SigningKeyPath is the default OpenPGP public key to verify the
+	// signature with
+	SigningKeyPath string
+	// Packages are installed into the image with InstallCommand after
+	// pulling it, e.g. the container runtime
+	Packages       []string
+	InstallCommand string
+}
+
+var builtinBaseImages = map[string]*BaseImage{
+	"flatcar": {
+		Name:           "flatcar",
+		URL:            defaultFlatcarMirror + flatcarImageFile,
+		Type:           BaseImageTypeRaw,
+		MinVersion:     "1478.0.0",
+		SignatureURL:   defaultFlatcarMirror + flatcarImageFile + ".sig",
+		SigningKeyPath: DefaultFlatcarSigningKeyPath,
+	},
+	"debian": {
+		Name:           "kube-spawn-debian",
+		URL:            "https://cloud.debian.org/images/cloud/buster/latest/debian-10-nocloud-$ARCH.qcow2",
+		Type:           BaseImageTypeRaw,
+		MinVersion:     "10",
+		Packages:       []string{"docker.io", "iptables", "ebtables", "ethtool", "conntrack", "socat"},
+		InstallCommand: "apt-get update && DEBIAN_FRONTEND=noninteractive apt-get install -y",
+	},
+	"fedora": {
+		Name:           "kube-spawn-fedora",
+		URL:            "https://download.fedoraproject.org/pub/fedora/linux/releases/30/Cloud/$MACHINE/images/Fedora-Cloud-Base-30-1.2.$MACHINE.raw.xz",
+		Type:           BaseImageTypeRaw,
+		MinVersion:     "30",
+		Packages:       []string{"docker", "iptables", "ebtables", "ethtool", "conntrack-tools", "socat"},
+		InstallCommand: "dnf install -y",
+	},
+}
+
+var invalidImageNameCharsRegexp = regexp.MustCompile("[^a-zA-Z0-9-]")
+
+// BaseImageNames returns the names of the built-in base images
+func BaseImageNames() []string {
+	var names []string
+	for name := range builtinBaseImages {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// UnsignedBaseImageNames returns the names of the built-in base images
+// which are published without a signature and thus can only be used
+// with SkipVerify
+func UnsignedBaseImageNames() []string {
+	var names []string
+	for _, name := range BaseImageNames() {
+		if builtinBaseImages[name].SignatureURL == "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// GetBaseImage returns the base image referred to by nameOrPath, which
+// is either
+//
+//   - the name of a built-in base image, e.g. "flatcar"
+//   - the path to an image file or directory, which is imported on first
+//     use (see baseImageFromPath)
+//   - the name of an image imported with ImportBaseImage before
+func GetBaseImage(nameOrPath string) (*BaseImage, error) {
+	if baseImage, ok := builtinBaseImages[nameOrPath]; ok {
+		return baseImage, nil
+	}
+	if strings.Contains(nameOrPath, "/") {
+		return baseImageFromPath(nameOrPath)
+	}
+	if machinectl.ImageExists(nameOrPath) {
+		return withBuiltinChecks(&BaseImage{Name: nameOrPath}), nil
+	}
+	return nil, errors.Errorf("unknown base image %q (expected one of %s, an imported image or a path to an image file)", nameOrPath, strings.Join(BaseImageNames(), ", "))
+}
+
+// baseImageFromPath returns a base image imported from the given file or
+// directory. Files ending in `.tar`, `.tar.gz` or `.tar.xz` are imported
+// as tar archives, other files as raw disk images and directories as
+// plain filesystem trees.
+func baseImageFromPath(imagePath string) (*BaseImage, error) {
+	absPath, err := filepath.Abs(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "cannot use base image file")
+	}
+
+	base := filepath.Base(absPath)
+	imageType := BaseImageTypeRaw
+	if info.IsDir() {
+		imageType = BaseImageTypeFs
+	} else {
+		for _, ext := range []string{".tar", ".tar.gz", ".tar.xz"} {
+			if strings.HasSuffix(base, ext) {
+				imageType = BaseImageTypeTar
+			}
+		}
+		base = strings.SplitN(base, ".", 2)[0]
+	}
+	return &BaseImage{
+		Name: "kube-spawn-" + invalidImageNameCharsRegexp.ReplaceAllString(base, "-"),
+		Path: absPath,
+		Type: imageType,
+	}, nil
+}
+
+// withBuiltinChecks applies the version check of the built-in base
+// image with the same name or pool name, e.g. to an image imported as
+// "flatcar" or "kube-spawn-debian"
+func withBuiltinChecks(baseImage *BaseImage) *BaseImage {
+	for key, builtin := range builtinBaseImages {
+		if key == baseImage.Name || builtin.Name == baseImage.Name {
+			baseImage.MinVersion = builtin.MinVersion
+		}
+	}
+	return baseImage
+}
+
+// ImportBaseImage imports the image file or directory at imagePath into
+// the machined image pool, so that it can be used without network access.
+// If name is empty, it is derived from the file name. Importing an image
+// with the name of a built-in base image (e.g. "debian") stores it under
+// the pool name of that image (e.g. "kube-spawn-debian") and so replaces
+// its download. The machine pool is grown for the image only if
+// growPool is set. Imported images are expected to contain all
+// required packages already.
+func ImportBaseImage(imagePath, name string, growPool bool) (*BaseImage, error) {
+	baseImage, err := baseImageFromPath(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	if name != "" {
+		baseImage.Name = name
+	}
+	if builtin, ok := builtinBaseImages[baseImage.Name]; ok {
+		baseImage.Name = builtin.Name
+	}
+	baseImage = withBuiltinChecks(baseImage)
+
+	if machinectl.ImageExists(baseImage.Name) {
+		return nil, errors.Errorf("image %q exists already (remove it with 'sudo machinectl remove %s' first)", baseImage.Name, baseImage.Name)
+	}
+	if err := EnsurePoolSize(minPoolSize, growPool); err != nil {
+		return nil, err
+	}
+	log.Printf("importing %s as %s image...", baseImage.Path, baseImage.Name)
+	if err := baseImage.importImage(baseImage.Path); err != nil {
+		return nil, err
+	}
+	if err := baseImage.checkVersion(); err != nil {
+		if removeErr := machinectl.Remove(baseImage.Name); removeErr != nil {
+			log.Printf("Failed to remove image %s: %v", baseImage.Name, removeErr)
+		}
+		return nil, err
+	}
+	return baseImage, nil
+}
+
+// source returns the URL or path the image is pulled or imported from
+func (b *BaseImage) source(channelName string) string {
+	if b.Path != "" {
+		return b.Path
+	}
+	return b.channelURL(b.URL, channelName)
+}
+
+// channelURL fills in the release channel and architecture
+func (b *BaseImage) channelURL(url, channelName string) string {
+	return expandURL(url, "", channelName)
+}
+
+// fetch adds the image to the image pool. Images with a URL are
+// downloaded and verified, unless verification is disabled.
+func (b *BaseImage) fetch(ctx context.Context, channelName string, verification *ImageVerification) error {
+	if b.Path != "" {
+		return b.importImage(b.Path)
+	}
+	if verification.SkipVerify {
+		log.Printf("WARNING: not verifying the signature of the %s image", b.Name)
+		return b.pull(b.source(channelName))
+	}
+	return b.downloadVerified(ctx, channelName, verification)
+}
+
+// pull pulls the image from url without verifying it
+func (b *BaseImage) pull(url string) error {
+	return runMachinectlImport("pull-"+b.Type, "--verify=no", url, b.Name)
+}
+
+func (b *BaseImage) importImage(imagePath string) error {
+	return runMachinectlImport("import-"+b.Type, imagePath, b.Name)
+}
+
+func runMachinectlImport(args ...string) error {
+	var cmdPath string
+	var err error
+
+	// TODO: use machinectl pkg
+	if cmdPath, err = exec.LookPath("machinectl"); err != nil {
+		return fmt.Errorf("systemd-nspawn / machinectl not installed: %s", err)
+	}
+
+	args = append([]string{cmdPath}, args...)
+
+	cmd := exec.Cmd{
+		Path:   cmdPath,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running machinectl %s: %s", args[1], err)
+	}
+
+	return nil
+}
+
+// installPackages installs the required packages into the image with
+// systemd-nspawn, before any machine is cloned from it
+func (b *BaseImage) installPackages() error {
+	if len(b.Packages) == 0 {
+		return nil
+	}
+
+	var cmdPath string
+	var err error
+
+	if cmdPath, err = exec.LookPath("systemd-nspawn"); err != nil {
+		return fmt.Errorf("systemd-nspawn not installed: %s", err)
+	}
+
+	args := []string{
+		cmdPath,
+		"--quiet",
+		"--machine", b.Name,
+		"/bin/sh", "-c", fmt.Sprintf("%s %s", b.InstallCommand, strings.Join(b.Packages, " ")),
+	}
+
+	cmd := exec.Cmd{
+		Path:   cmdPath,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error installing packages into %s: %s", b.Name, err)
+	}
+
+	return nil
+}
+
+func (b *BaseImage) checkVersionField(values []string) error {
+	minVersion, err := semver.NewConstraint(">=" + b.MinVersion)
+	if err != nil {
+		return errors.Wrapf(err, "cannot get constraint for >= %s", b.MinVersion)
+	}
+	for _, value := range values {
+		v, err := semver.NewVersion(strings.TrimSpace(value))
+		if err != nil {
+			// just meaning it's not a version field, so continue to the next field
+			continue
+		}
+		if !minVersion.Check(v) {
+			return fmt.Errorf("ERROR: %s version %s is too low in your local image, at least %s is required.", b.Name, v, b.MinVersion)
+		}
+		return nil
+	}
+	return fmt.Errorf("cannot find a version field")
+}
+
+func (b *BaseImage) checkVersion() error {
+	if b.MinVersion == "" {
+		return nil
+	}
+
+	args := []string{
+		"image-status",
+		b.Name,
+	}
+
+	cmd := exec.Command("machinectl", args...)
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+
+	out, err := cmd.Output()
+	if err != nil {
+		return err
+	}
+
+	s := bufio.NewScanner(strings.NewReader(string(out)))
+	for s.Scan() {
+		// an example line from machinectl image-status:
+		//  OS: Container Linux by CoreOS 1478.0.0 (Ladybug)
+
+		line := strings.SplitN(s.Text(), ":", 2)
+		if len(line) <= 1 {
+			continue
+		}
+
+		keyStr := strings.TrimSpace(line[0])
+		valueStr := strings.TrimSpace(line[1])
+		if keyStr != "OS" {
+			continue
+		}
+
+		// now the line has the key "OS", so get the version field in the values
+		return b.checkVersionField(strings.Fields(valueStr))
+	}
+
+	return nil
+}
+
+func ensureBaseImageVersion(baseImage *BaseImage) error {
+	if err := baseImage.checkVersion(); err != nil {
+		return errors.Errorf("%v\nYou will need to remove the image by 'sudo machinectl remove %s' then the next run of kube-spawn will download it again.", err, baseImage.Name)
+	}
+	return nil
+}
+
+// PrepareBaseImage pulls or imports the base image and installs the
+// required packages into it, unless the image exists already
+func PrepareBaseImage(ctx context.Context, baseImage *BaseImage, channelName string, verification *ImageVerification, growPool bool) error {
+	// If no image exists, just download it
+	if !machinectl.ImageExists(baseImage.Name) {
+		if err := EnsurePoolSize(minPoolSize, growPool); err != nil {
+			return err
+		}
+		log.Printf("pulling %s image...", baseImage.Name)
+		if err := baseImage.fetch(ctx, channelName, verification); err != nil {
+			return err
+		}
+		if err := baseImage.installPackages(); err != nil {
+			// Don't leave an image without the packages behind, it
+			// would be used as is on the next run
+			if removeErr := machinectl.Remove(baseImage.Name); removeErr != nil {
+				log.Printf("Failed to remove image %s: %v", baseImage.Name, removeErr)
+			}
+			return err
+		}
+	} else {
+		// If the image is not new enough, remove the existing image,
+		// then next time `kube-spawn up` will download a new image again.
+		if err := ensureBaseImageVersion(baseImage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
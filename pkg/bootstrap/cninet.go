@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
 const NspawnNetPath string = "/etc/cni/net.d/10-kube-spawn-net.conf"
@@ -54,3 +55,43 @@ func WriteNetConf() error {
 	}
 	return nil
 }
+
+// CNI host-local IPAM keeps a file named after every allocated IP in this
+// directory
+const cniLeaseDir string = "/var/lib/cni/networks/kube-spawn-net"
+
+// ReleaseNetworkLeases removes the host-local IPAM reservations of the
+// given container, so that its IPs can be used for other machines again.
+// Machines are started with their name as container ID. The lease files
+// contain the container ID, followed by the interface name in newer
+// versions of the plugin.
+func ReleaseNetworkLeases(containerID string) error {
+	entries, err := ioutil.ReadDir(cniLeaseDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("error reading CNI leases: %s", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), "last_reserved_ip") || entry.Name() == "lock" {
+			continue
+		}
+		leasePath := path.Join(cniLeaseDir, entry.Name())
+		content, err := ioutil.ReadFile(leasePath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("error reading CNI lease %s: %s", leasePath, err)
+		}
+		id := strings.TrimSpace(strings.SplitN(string(content), "\n", 2)[0])
+		if id != containerID {
+			continue
+		}
+		if err := os.Remove(leasePath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error removing CNI lease %s: %s", leasePath, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,332 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+// minSystemdVersion is the oldest systemd-nspawn kube-spawn works with
+const minSystemdVersion = 233
+
+const brNetfilterSysctl = "/proc/sys/net/bridge/bridge-nf-call-iptables"
+
+// CheckHost checks the host requirements of kube-spawn without changing
+// anything. Requirements which `start` sets up itself, like loading the
+// overlay module, are reported as warnings. Without root privileges, the
+// checks which need them are reported as warnings as well.
+func CheckHost(kubespawnDir string) []Check {
+	var checks []Check
+	if unix.Geteuid() != 0 {
+		checks = append(checks, Check{
+			Name:    "privileges",
+			Status:  CheckWarn,
+			Message: "not running as root, the iptables rules cannot be checked",
+			Hint:    "run `sudo kube-spawn doctor` for all checks",
+		})
+	}
+	checks = append(checks, checkSystemdVersion())
+	checks = append(checks, checkTool("machinectl", "systemd-container"))
+	checks = append(checks, checkTool("systemd-run", "systemd"))
+	checks = append(checks, checkTool("modprobe", "kmod"))
+	checks = append(checks, checkOverlayfs())
+	checks = append(checks, checkDirOverlay(kubespawnDir))
+	checks = append(checks, checkConntrack())
+	checks = append(checks, checkBrNetfilter())
+	checks = append(checks, checkIptables()...)
+	checks = append(checks, checkSelinux())
+	checks = append(checks, checkCgroups())
+	checks = append(checks, checkFreeSpace(kubespawnDir))
+	return checks
+}
+
+func checkSystemdVersion() Check {
+	check := Check{Name: "systemd-nspawn"}
+	out, err := exec.Command("systemd-nspawn", "--version").Output()
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("cannot run systemd-nspawn: %v", err)
+		check.Hint = "install systemd-nspawn, e.g. the package systemd-container"
+		return check
+	}
+	// e.g. `systemd 239 (239-3.fc29)`
+	fields := strings.Fields(string(out))
+	var version int
+	if len(fields) >= 2 {
+		version, err = strconv.Atoi(fields[1])
+	}
+	if len(fields) < 2 || err != nil {
+		check.Status = CheckWarn
+		check.Message = fmt.Sprintf("cannot parse version %q", strings.TrimSpace(string(out)))
+		return check
+	}
+	if version < minSystemdVersion {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("version %d is too old, at least %d is required", version, minSystemdVersion)
+		check.Hint = "upgrade systemd"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = fmt.Sprintf("version %d", version)
+	return check
+}
+
+// checkTool checks that the command name is available. pkg is the
+// package usually providing it.
+func checkTool(name, pkg string) Check {
+	check := Check{Name: name}
+	toolPath, err := exec.LookPath(name)
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("%s not found in $PATH", name)
+		check.Hint = fmt.Sprintf("install %s, e.g. the package %s", name, pkg)
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = toolPath
+	return check
+}
+
+func checkOverlayfs() Check {
+	check := Check{Name: "overlayfs"}
+	if isOverlayfsAvailable() {
+		check.Status = CheckOK
+		check.Message = "available"
+		return check
+	}
+	check.Status = CheckWarn
+	check.Message = "overlay module not loaded, start will try to load it"
+	check.Hint = "modprobe overlay"
+	return check
+}
+
+// checkDirOverlay checks that the kube-spawn dir, or the directory it
+// will be created in, can hold the lower and upper dirs of overlayfs
+func checkDirOverlay(dir string) Check {
+	check := Check{Name: "overlayfs support of " + dir}
+	existing := existingParent(dir)
+	if err := pathSupportsOverlay(existing); err != nil {
+		check.Status = CheckFail
+		check.Message = err.Error()
+		check.Hint = "use a directory on a filesystem with d_type support, e.g. ext4 or xfs with ftype=1, with --dir"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "supported"
+	return check
+}
+
+func checkConntrack() Check {
+	check := Check{Name: "nf_conntrack"}
+	if !isConntrackLoaded() {
+		check.Status = CheckWarn
+		check.Message = "module not loaded, start will try to load it"
+		check.Hint = "modprobe nf_conntrack"
+		return check
+	}
+	if _, err := isConntrackHashsizeCorrect(); err != nil {
+		check.Status = CheckFail
+		check.Message = strings.TrimSpace(err.Error())
+		check.Hint = fmt.Sprintf("raise %s to at least a quarter of %s", ctHashsizeModparam, ctMaxSysctl)
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "hashsize sufficient"
+	return check
+}
+
+func checkBrNetfilter() Check {
+	check := Check{Name: "br_netfilter"}
+	content, err := ioutil.ReadFile(brNetfilterSysctl)
+	if err != nil {
+		check.Status = CheckWarn
+		check.Message = "module not loaded, bridged traffic bypasses iptables"
+		check.Hint = "modprobe br_netfilter"
+		return check
+	}
+	if strings.TrimSpace(string(content)) != "1" {
+		check.Status = CheckWarn
+		check.Message = "bridged traffic bypasses iptables"
+		check.Hint = "sysctl -w net.bridge.bridge-nf-call-iptables=1"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "bridged traffic passes iptables"
+	return check
+}
+
+var forwardPolicyRegexp = regexp.MustCompile(`(?m)^-P FORWARD (\S+)$`)
+
+func checkIptables() []Check {
+	check := Check{Name: "iptables"}
+	out, err := exec.Command("iptables", "--version").Output()
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("cannot run iptables: %v", err)
+		check.Hint = "install iptables"
+		return []Check{check}
+	}
+	version := strings.TrimSpace(string(out))
+	if strings.Contains(version, "nf_tables") {
+		check.Status = CheckWarn
+		check.Message = fmt.Sprintf("%s uses the nftables backend, rules might not match the ones of the nodes", version)
+		check.Hint = "switch to the legacy backend, e.g. with `update-alternatives --set iptables /usr/sbin/iptables-legacy`"
+	} else {
+		check.Status = CheckOK
+		check.Message = version
+	}
+	checks := []Check{check}
+	if unix.Geteuid() != 0 {
+		// reading the rules needs root, see CheckHost
+		return checks
+	}
+
+	forward := Check{Name: "iptables FORWARD policy"}
+	out, err = exec.Command("iptables", "-S", "FORWARD").Output()
+	if match := forwardPolicyRegexp.FindSubmatch(out); err != nil || match == nil {
+		forward.Status = CheckWarn
+		forward.Message = "cannot read the FORWARD chain"
+	} else if policy := string(match[1]); policy != "ACCEPT" {
+		forward.Status = CheckWarn
+		forward.Message = fmt.Sprintf("policy is %s, start will set it to ACCEPT", policy)
+		forward.Hint = "iptables -P FORWARD ACCEPT"
+	} else {
+		forward.Status = CheckOK
+		forward.Message = "policy is ACCEPT"
+	}
+	checks = append(checks, forward)
+
+	cniRule := Check{Name: "iptables CNI rule"}
+	if err := exec.Command("iptables", "-C", "FORWARD", "-i", "cni0", "-j", "ACCEPT").Run(); err != nil {
+		cniRule.Status = CheckWarn
+		cniRule.Message = "traffic from cni0 is not accepted yet, start will add the rule"
+		cniRule.Hint = "iptables -I FORWARD 1 -i cni0 -j ACCEPT"
+	} else {
+		cniRule.Status = CheckOK
+		cniRule.Message = "traffic from cni0 is accepted"
+	}
+	return append(checks, cniRule)
+}
+
+func checkSelinux() Check {
+	check := Check{Name: "SELinux"}
+	if isSELinuxEnforcing() {
+		check.Status = CheckFail
+		check.Message = "enforcing mode is enabled"
+		check.Hint = "sudo setenforce 0"
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "not enforcing"
+	return check
+}
+
+func checkCgroups() Check {
+	check := Check{Name: "cgroups"}
+	var stat unix.Statfs_t
+	if err := unix.Statfs("/sys/fs/cgroup", &stat); err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("cannot statfs /sys/fs/cgroup: %v", err)
+		return check
+	}
+	if stat.Type == unix.CGROUP2_SUPER_MAGIC {
+		check.Status = CheckFail
+		check.Message = "the unified hierarchy (cgroup v2) is used, which the Kubernetes versions kube-spawn supports cannot run on"
+		check.Hint = "boot with systemd.unified_cgroup_hierarchy=0 on the kernel command line"
+		return check
+	}
+	check.Status = CheckOK
+	if _, err := os.Stat("/sys/fs/cgroup/unified"); err == nil {
+		check.Message = "hybrid hierarchy (cgroup v1 controllers)"
+	} else {
+		check.Message = "legacy hierarchy (cgroup v1)"
+	}
+	return check
+}
+
+func checkFreeSpace(kubespawnDir string) Check {
+	check := Check{Name: "free space of " + kubespawnDir}
+	existing := existingParent(kubespawnDir)
+	free, err := getVolFreeSpace(existing)
+	if err != nil {
+		check.Status = CheckFail
+		check.Message = fmt.Sprintf("cannot determine free space: %v", err)
+		return check
+	}
+	check.Message = fmt.Sprintf("%s free", utils.FormatBytes(int64(free)))
+	if int64(free) < minPoolSize {
+		check.Status = CheckWarn
+		check.Hint = "free some space, e.g. with `kube-spawn cache prune` or by destroying unused clusters"
+		return check
+	}
+	check.Status = CheckOK
+	return check
+}
+
+// CheckBaseImage checks the version of the base image if it has been
+// downloaded or imported already
+func CheckBaseImage(baseImage *BaseImage) Check {
+	check := Check{Name: "base image " + baseImage.Name}
+	if !machinectl.ImageExists(baseImage.Name) {
+		check.Status = CheckOK
+		check.Message = "not in the pool yet, start will download it"
+		if baseImage.Path != "" {
+			check.Message = fmt.Sprintf("not in the pool yet, start will import it from %s", baseImage.Path)
+		} else if baseImage.URL == "" {
+			check.Status = CheckFail
+			check.Message = "not in the pool"
+			check.Hint = fmt.Sprintf("import it with `kube-spawn image import --name %s FILE`", baseImage.Name)
+		}
+		return check
+	}
+	if err := baseImage.checkVersion(); err != nil {
+		check.Status = CheckFail
+		check.Message = err.Error()
+		check.Hint = fmt.Sprintf("remove it with `sudo machinectl remove %s`, start will download it again", baseImage.Name)
+		return check
+	}
+	check.Status = CheckOK
+	check.Message = "present"
+	if baseImage.MinVersion != "" {
+		check.Message = fmt.Sprintf("present, at least version %s", baseImage.MinVersion)
+	}
+	return check
+}
+
+// existingParent returns dir or its closest parent which exists, so that
+// checks don't need to create directories
+func existingParent(dir string) string {
+	for dir != "/" {
+		if _, err := os.Stat(dir); err == nil {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	return dir
+}
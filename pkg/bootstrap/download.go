@@ -1,120 +1,224 @@
 package bootstrap
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
+	"sort"
 	"strings"
 	"sync"
 
+	"github.com/kinvolk/kube-spawn/pkg/cache"
 	"github.com/kinvolk/kube-spawn/pkg/utils"
 	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
 	"github.com/pkg/errors"
 )
 
-const (
-	k8sURL         string = "https://dl.k8s.io/$VERSION/bin/linux/amd64/"
-	k8sGithubURL   string = "https://raw.githubusercontent.com/kubernetes/kubernetes/$VERSION/build/rpms/"
-	staticSocatUrl string = "https://raw.githubusercontent.com/andrew-d/static-binaries/530df977dd38ba3b4197878b34466d49fce69d8e/binaries/linux/x86_64/socat"
-
-	sha1Suffix string = ".sha1"
-)
-
 var (
-	// note: we are downloading these in parallel (limit number or improve DownloadK8sBins func)
+	// note: these are downloaded in parallel, limited by the
+	// concurrency of the DefaultDownloader
 	//
-	// key: full URL for a file to be downloaded.
+	// key: name of a file in the Kubernetes mirror directory
 	// value: whether it has to be verified with checksum or not
 	k8sBinaryFiles = map[string]bool{
-		k8sURL + "kubelet":               true,
-		k8sURL + "kubeadm":               true,
-		k8sURL + "kubectl":               true,
-		k8sGithubURL + "kubelet.service": false,
-		k8sGithubURL + "10-kubeadm.conf": false,
+		"kubelet": true,
+		"kubeadm": true,
+		"kubectl": true,
+	}
+	// files in the Kubernetes systemd mirror directory, no checksums
+	// are published for them
+	k8sSystemdFiles = []string{
+		"kubelet.service",
+		"10-kubeadm.conf",
 	}
 )
 
-func Download(url, fpath string) error {
-	resp, err := http.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
+// DownloadError lists the files which could not be downloaded
+type DownloadError struct {
+	Errors map[string]error
+}
 
-	if resp.StatusCode != 200 {
-		return errors.Errorf("server returned [%d] %q", resp.StatusCode, resp.Status)
+func (e *DownloadError) Error() string {
+	var names []string
+	for name := range e.Errors {
+		names = append(names, name)
 	}
-	return fs.CreateFileFromReader(fpath, resp.Body)
+	sort.Strings(names)
+	var msgs []string
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %v", name, e.Errors[name]))
+	}
+	return fmt.Sprintf("failed to download %d file(s): %s", len(names), strings.Join(msgs, "; "))
 }
 
-func DownloadKubernetesBinaries(k8sVersion, targetDir string) error {
-	var err error
-	versionPath := path.Join(targetDir, k8sVersion)
-	if exists, err := fs.PathExists(versionPath); err != nil {
-		return err
-	} else if !exists {
-		if err := os.MkdirAll(versionPath, 0755); err != nil {
-			return err
-		}
+// KubernetesCacheDir returns the directory in the cache the Kubernetes
+// files of the given version are downloaded to, for the configured
+// architecture
+func KubernetesCacheDir(clusterCache *cache.Cache, k8sVersion string) string {
+	return clusterCache.FilePath(kubernetesCachePath(k8sVersion))
+}
+
+func kubernetesCachePath(k8sVersion string) string {
+	return path.Join(cache.ArtifactKubernetes, arch, k8sVersion)
+}
+
+// DownloadKubernetesBinaries downloads the Kubernetes binaries and
+// systemd files of the given version into KubernetesCacheDir. Binaries
+// are verified against the SHA-512 (or SHA-256) checksums published
+// upstream. The digests of all files are recorded in the cache index;
+// cached files are checked against it before use and downloaded again
+// if they don't match.
+//
+// All files are tried, failures are returned as DownloadError.
+func DownloadKubernetesBinaries(ctx context.Context, k8sVersion string, clusterCache *cache.Cache) error {
+	var (
+		wg          sync.WaitGroup
+		resultMutex sync.Mutex
+		fileErrors  = make(map[string]error)
+	)
+	files := make(map[string]bool)
+	for name, verifyHash := range k8sBinaryFiles {
+		files[joinURL(expandURL(mirrors.Kubernetes, k8sVersion, ""), name)] = verifyHash
+	}
+	for _, name := range k8sSystemdFiles {
+		files[joinURL(expandURL(mirrors.KubernetesSystemd, k8sVersion, ""), name)] = false
 	}
 
-	var wg sync.WaitGroup
-	wg.Add(len(k8sBinaryFiles))
-	for url, verifyHash := range k8sBinaryFiles {
-		// replace placeholder $VERSION with actual version parameter
-		go func(url string, verifyHash bool) {
+	for url, verifyHash := range files {
+		entry := &cache.Entry{
+			Artifact: cache.ArtifactKubernetes,
+			Version:  k8sVersion,
+			Arch:     arch,
+			Path:     path.Join(kubernetesCachePath(k8sVersion), path.Base(url)),
+			URL:      url,
+		}
+
+		wg.Add(1)
+		go func(verifyHash bool) {
 			defer wg.Done()
-			url = strings.Replace(url, "$VERSION", k8sVersion, 1)
-			inCachePath := path.Join(versionPath, path.Base(url))
-			if exists, err := fs.PathExists(inCachePath); err != nil {
-				log.Printf("Error checking if path %q exists: %v\n", inCachePath, err)
-				return
-			} else if !exists {
-				log.Printf("Downloading %s", path.Base(inCachePath))
-				if err = Download(url, inCachePath); err != nil {
-					err = errors.Wrapf(err, "error downloading %s", url)
-					return
-				}
-
-				if verifyHash {
-					sha1URL := url + sha1Suffix
-					sha1CachePath := inCachePath + sha1Suffix
-					if err = Download(sha1URL, sha1CachePath); err != nil {
-						err = errors.Wrapf(err, "error downloading %s", sha1URL)
-						return
-					}
-
-					if err = utils.VerifySha1(inCachePath, sha1CachePath); err != nil {
-						err = errors.Wrapf(err, "error verifying checksum of %s", sha1URL)
-						return
-					}
-				}
+			if err := downloadCachedFile(ctx, clusterCache, entry, verifyHash); err != nil {
+				resultMutex.Lock()
+				defer resultMutex.Unlock()
+				fileErrors[path.Base(entry.Path)] = err
 			}
-		}(url, verifyHash)
+		}(verifyHash)
 	}
 	wg.Wait()
 
-	return err
+	if len(fileErrors) > 0 {
+		return &DownloadError{Errors: fileErrors}
+	}
+	return nil
 }
 
-func DownloadSocatBin(targetDir string) error {
-	if exists, err := fs.PathExists(targetDir); err != nil {
-		return err
-	} else if !exists {
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
+// downloadCachedFile makes sure the file described by entry is in the
+// cache and recorded in its index. A cached file is used if it matches
+// the digest recorded before, otherwise it is downloaded again.
+func downloadCachedFile(ctx context.Context, clusterCache *cache.Cache, entry *cache.Entry, verifyHash bool) error {
+	cachePath := clusterCache.FilePath(entry.Path)
+	exists, err := fs.PathExists(cachePath)
+	if err != nil {
+		return errors.Wrapf(err, "error checking if path %q exists", cachePath)
+	}
+	if exists {
+		known, err := clusterCache.Entry(entry.Path)
+		if err != nil {
+			return err
+		}
+		if known != nil && (known.Verified || !verifyHash) {
+			if err := clusterCache.Verify(known); err == nil {
+				return clusterCache.Touch(entry.Path)
+			}
+			log.Printf("Cached %s is corrupt, downloading it again", entry.Path)
+		}
+		if err := os.Remove(cachePath); err != nil {
 			return err
 		}
 	}
-	inCachePath := path.Join(targetDir, path.Base(staticSocatUrl))
-
-	if exists, err := fs.PathExists(inCachePath); err != nil {
-		return err
-	} else if !exists {
-		log.Printf("downloading %s", path.Base(inCachePath))
-		if err := Download(staticSocatUrl, inCachePath); err != nil {
-			return errors.Wrapf(err, "error downloading %s", staticSocatUrl)
+
+	if verifyHash {
+		entry.Algorithm, entry.Digest, err = fetchChecksum(ctx, entry.URL)
+		if err != nil {
+			return err
 		}
+		entry.Verified = true
 	}
-	return nil
+
+	log.Printf("Downloading %s", entry.Path)
+	if err := Download(ctx, entry.URL, cachePath); err != nil {
+		return errors.Wrapf(err, "error downloading %s", entry.URL)
+	}
+
+	if verifyHash {
+		if err := utils.VerifyFileDigest(cachePath, entry.Algorithm, entry.Digest); err != nil {
+			os.Remove(cachePath)
+			return err
+		}
+	} else {
+		entry.Algorithm = utils.SHA256
+		entry.Digest, err = utils.FileDigest(cachePath, entry.Algorithm)
+		if err != nil {
+			return err
+		}
+	}
+	return clusterCache.Record(entry)
+}
+
+// fetchChecksum downloads the published checksum of url, preferring
+// SHA-512 over SHA-256. Checksum files contain the hex encoded digest,
+// optionally followed by the file name.
+func fetchChecksum(ctx context.Context, url string) (string, string, error) {
+	var lastErr error
+	for _, algorithm := range []string{utils.SHA512, utils.SHA256} {
+		req, err := http.NewRequest("GET", url+"."+algorithm, nil)
+		if err != nil {
+			return "", "", err
+		}
+		resp, err := DefaultDownloader.Client.Do(req.WithContext(ctx))
+		if err != nil {
+			return "", "", errors.Wrapf(err, "error downloading checksum of %s", url)
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		if err != nil {
+			return "", "", errors.Wrapf(err, "error downloading checksum of %s", url)
+		}
+		if resp.StatusCode != http.StatusOK {
+			lastErr = errors.Errorf("server returned [%d] %q for %s", resp.StatusCode, resp.Status, url+"."+algorithm)
+			continue
+		}
+		fields := strings.Fields(string(content))
+		if len(fields) == 0 {
+			return "", "", errors.Errorf("empty checksum file %s", url+"."+algorithm)
+		}
+		return algorithm, fields[0], nil
+	}
+	return "", "", errors.Wrapf(lastErr, "no checksum published for %s", url)
+}
+
+// SocatCachePath returns the path of the socat binary for the configured
+// architecture in the cache
+func SocatCachePath(clusterCache *cache.Cache) string {
+	return clusterCache.FilePath(socatCachePath())
+}
+
+func socatCachePath() string {
+	return path.Join(cache.ArtifactSocat, arch, "socat")
+}
+
+func DownloadSocatBin(ctx context.Context, clusterCache *cache.Cache) error {
+	if mirrors.Socat == defaultSocatMirror && arch != "amd64" {
+		return errors.Errorf("no static socat binary for %s is available upstream, configure a socat mirror", arch)
+	}
+	return downloadCachedFile(ctx, clusterCache, &cache.Entry{
+		Artifact: cache.ArtifactSocat,
+		Arch:     arch,
+		Path:     socatCachePath(),
+		URL:      expandURL(mirrors.Socat, "", ""),
+	}, false)
 }
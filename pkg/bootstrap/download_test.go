@@ -0,0 +1,147 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+	"github.com/pkg/errors"
+)
+
+const (
+	testSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	testSHA512 = "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"
+)
+
+func TestFetchChecksum(t *testing.T) {
+	tests := []struct {
+		name string
+		// files served by the test server, missing files return 404
+		files     map[string]string
+		status    map[string]int
+		algorithm string
+		digest    string
+		err       string
+	}{
+		{
+			name:      "sha512 with file name",
+			files:     map[string]string{"/kubelet.sha512": testSHA512 + "  kubelet\n"},
+			algorithm: utils.SHA512,
+			digest:    testSHA512,
+		},
+		{
+			name:      "bare digest",
+			files:     map[string]string{"/kubelet.sha512": testSHA512},
+			algorithm: utils.SHA512,
+			digest:    testSHA512,
+		},
+		{
+			name: "sha512 preferred",
+			files: map[string]string{
+				"/kubelet.sha512": testSHA512 + "\n",
+				"/kubelet.sha256": testSHA256 + "\n",
+			},
+			algorithm: utils.SHA512,
+			digest:    testSHA512,
+		},
+		{
+			name:      "sha256 fallback on 404",
+			files:     map[string]string{"/kubelet.sha256": testSHA256 + "  kubelet\n"},
+			algorithm: utils.SHA256,
+			digest:    testSHA256,
+		},
+		{
+			name:      "sha256 fallback on server error",
+			files:     map[string]string{"/kubelet.sha256": testSHA256},
+			status:    map[string]int{"/kubelet.sha512": http.StatusInternalServerError},
+			algorithm: utils.SHA256,
+			digest:    testSHA256,
+		},
+		{
+			name:  "no checksum",
+			files: map[string]string{},
+			err:   "no checksum published for",
+		},
+		{
+			name:  "empty checksum file",
+			files: map[string]string{"/kubelet.sha512": "\n"},
+			err:   "empty checksum file",
+		},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if status, ok := test.status[r.URL.Path]; ok {
+				w.WriteHeader(status)
+				return
+			}
+			content, ok := test.files[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			fmt.Fprint(w, content)
+		}))
+
+		algorithm, digest, err := fetchChecksum(context.Background(), server.URL+"/kubelet")
+		server.Close()
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		if algorithm != test.algorithm || digest != test.digest {
+			t.Errorf("%s: expected %s %s, got %s %s", test.name, test.algorithm, test.digest, algorithm, digest)
+		}
+	}
+}
+
+func TestDownloadError(t *testing.T) {
+	tests := []struct {
+		errors   map[string]error
+		expected string
+	}{
+		{
+			errors:   map[string]error{"kubelet": errors.New("timeout")},
+			expected: "failed to download 1 file(s): kubelet: timeout",
+		},
+		{
+			errors: map[string]error{
+				"kubectl": errors.New("checksum mismatch"),
+				"kubeadm": errors.New("server returned [404]"),
+				"kubelet": errors.New("timeout"),
+			},
+			expected: "failed to download 3 file(s): kubeadm: server returned [404]; kubectl: checksum mismatch; kubelet: timeout",
+		},
+	}
+	for _, test := range tests {
+		err := &DownloadError{Errors: test.errors}
+		if err.Error() != test.expected {
+			t.Errorf("expected %q, got %q", test.expected, err.Error())
+		}
+	}
+}
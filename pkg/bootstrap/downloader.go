@@ -0,0 +1,262 @@
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+const (
+	defaultDownloadConcurrency = 4
+	defaultDownloadRetries     = 3
+	defaultDownloadRetryDelay  = 2 * time.Second
+
+	partialSuffix = ".part"
+)
+
+// DefaultDownloader is used by Download and the other download helpers
+// of this package
+var DefaultDownloader = NewDownloader()
+
+// Downloader downloads files over HTTP. Files are written to a temporary
+// file next to the destination and only renamed into place once they are
+// complete, so an interrupted download never leaves a truncated file
+// behind. Failed downloads are retried with exponential backoff and
+// resumed with range requests where the server supports it.
+type Downloader struct {
+	Client *http.Client
+	// Concurrency limits the number of files downloaded at the same time
+	Concurrency int
+	// Retries is the number of times a failed download is retried
+	Retries int
+	// RetryDelay is the delay before the first retry, it doubles with
+	// every further attempt
+	RetryDelay time.Duration
+	// Progress receives progress updates, nil disables them
+	Progress io.Writer
+
+	semOnce sync.Once
+	sem     chan struct{}
+}
+
+func NewDownloader() *Downloader {
+	return &Downloader{
+		Client: &http.Client{
+			Transport: &http.Transport{
+				Proxy: http.ProxyFromEnvironment,
+				DialContext: (&net.Dialer{
+					Timeout:   30 * time.Second,
+					KeepAlive: 30 * time.Second,
+				}).DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 30 * time.Second,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		},
+		Concurrency: defaultDownloadConcurrency,
+		Retries:     defaultDownloadRetries,
+		RetryDelay:  defaultDownloadRetryDelay,
+	}
+}
+
+// Download downloads url to fpath with the DefaultDownloader
+func Download(ctx context.Context, url, fpath string) error {
+	return DefaultDownloader.Download(ctx, url, fpath)
+}
+
+// Download downloads url to fpath
+func (d *Downloader) Download(ctx context.Context, url, fpath string) error {
+	if err := d.acquire(ctx); err != nil {
+		return err
+	}
+	defer d.release()
+
+	if err := os.MkdirAll(path.Dir(fpath), 0755); err != nil {
+		return errors.Wrapf(err, "error creating directory %q", path.Dir(fpath))
+	}
+	partialPath := fpath + partialSuffix
+
+	delay := d.RetryDelay
+	for attempt := 0; ; attempt++ {
+		err := d.fetch(ctx, url, partialPath)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil {
+			os.Remove(partialPath)
+			return ctx.Err()
+		}
+		if _, ok := err.(permanentError); ok || attempt >= d.Retries {
+			os.Remove(partialPath)
+			return err
+		}
+		d.progressf("%s: %v, retrying in %s (%d/%d)", path.Base(fpath), err, delay, attempt+1, d.Retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			os.Remove(partialPath)
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+
+	if err := os.Rename(partialPath, fpath); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return nil
+}
+
+// permanentError is returned for failures which won't go away by
+// retrying, e.g. a missing file
+type permanentError struct {
+	error
+}
+
+// fetch downloads url to partialPath, continuing from the end of an
+// existing partial file if the server supports range requests
+func (d *Downloader) fetch(ctx context.Context, url, partialPath string) error {
+	var offset int64
+	if info, err := os.Stat(partialPath); err == nil {
+		offset = info.Size()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return permanentError{err}
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := d.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusOK:
+		// the server sent the whole file, start over
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		flags |= os.O_APPEND
+	case http.StatusRequestedRangeNotSatisfiable:
+		// the partial file is not a prefix of what the server has
+		// (anymore), so throw it away and retry from the start
+		os.Remove(partialPath)
+		return errors.Errorf("server rejected resuming at byte %d", offset)
+	default:
+		err := errors.Errorf("server returned [%d] %q", resp.StatusCode, resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusRequestTimeout && resp.StatusCode != http.StatusTooManyRequests {
+			return permanentError{err}
+		}
+		return err
+	}
+
+	f, err := os.OpenFile(partialPath, flags, 0755)
+	if err != nil {
+		return errors.Wrapf(err, "error creating %q", partialPath)
+	}
+	defer f.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+	progress := &progressWriter{
+		downloader: d,
+		name:       path.Base(url),
+		written:    offset,
+		total:      total,
+		lastUpdate: time.Now(),
+	}
+	if _, err := io.Copy(io.MultiWriter(f, progress), resp.Body); err != nil {
+		return errors.Wrapf(err, "error downloading %s", url)
+	}
+	if total >= 0 && progress.written != total {
+		return errors.Errorf("download of %s incomplete: got %d of %d bytes", url, progress.written, total)
+	}
+	progress.done()
+	return nil
+}
+
+func (d *Downloader) acquire(ctx context.Context) error {
+	d.semOnce.Do(func() {
+		concurrency := d.Concurrency
+		if concurrency < 1 {
+			concurrency = 1
+		}
+		d.sem = make(chan struct{}, concurrency)
+	})
+	select {
+	case d.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (d *Downloader) release() {
+	<-d.sem
+}
+
+func (d *Downloader) progressf(format string, args ...interface{}) {
+	if d.Progress == nil {
+		return
+	}
+	fmt.Fprintf(d.Progress, format+"\n", args...)
+}
+
+const progressInterval = 2 * time.Second
+
+// progressWriter reports the progress of a download every
+// progressInterval. Several downloads can run at the same time, so
+// every update is printed on its own line.
+type progressWriter struct {
+	downloader *Downloader
+	name       string
+	written    int64
+	total      int64
+	lastUpdate time.Time
+	reported   bool
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.written += int64(len(b))
+	if time.Since(p.lastUpdate) >= progressInterval {
+		p.lastUpdate = time.Now()
+		p.reported = true
+		p.report()
+	}
+	return len(b), nil
+}
+
+func (p *progressWriter) report() {
+	if p.total > 0 {
+		p.downloader.progressf("%s: %s of %s (%d%%)", p.name, utils.FormatBytes(p.written), utils.FormatBytes(p.total), p.written*100/p.total)
+	} else {
+		p.downloader.progressf("%s: %s", p.name, utils.FormatBytes(p.written))
+	}
+}
+
+func (p *progressWriter) done() {
+	// only report completion for downloads which took long enough to
+	// show progress
+	if p.reported {
+		p.report()
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testContent = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+func newTestDownloader(retries int) *Downloader {
+	return &Downloader{
+		Client:      &http.Client{},
+		Concurrency: defaultDownloadConcurrency,
+		Retries:     retries,
+		RetryDelay:  time.Millisecond,
+	}
+}
+
+func testDownloadDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "kube-spawn-download")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func checkDownloaded(t *testing.T, name, fpath, expected string) {
+	content, err := ioutil.ReadFile(fpath)
+	if err != nil {
+		t.Errorf("%s: %v", name, err)
+		return
+	}
+	if string(content) != expected {
+		t.Errorf("%s: expected content %q, got %q", name, expected, content)
+	}
+	if _, err := os.Stat(fpath + partialSuffix); !os.IsNotExist(err) {
+		t.Errorf("%s: partial file left behind", name)
+	}
+}
+
+func TestDownloaderResume(t *testing.T) {
+	tests := []struct {
+		name string
+		// partial is the content of the .part file before the download
+		partial string
+		// supportsRange makes the server answer range requests with 206
+		supportsRange bool
+		// rejectRange makes the server answer range requests with 416
+		rejectRange bool
+		// requests is the expected number of requests
+		requests int32
+	}{
+		{name: "no partial file", supportsRange: true, requests: 1},
+		{name: "resume with 206", partial: testContent[:10], supportsRange: true, requests: 1},
+		{name: "fallback on 200", partial: testContent[:10], requests: 1},
+		{name: "garbage partial file with 200", partial: "garbage", requests: 1},
+		{name: "restart on 416", partial: "garbage", rejectRange: true, requests: 2},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			rangeHeader := r.Header.Get("Range")
+			if rangeHeader != "" && test.rejectRange {
+				w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+				return
+			}
+			if rangeHeader != "" && test.supportsRange {
+				var offset int
+				if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-", &offset); err != nil || offset > len(testContent) {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, len(testContent)-1, len(testContent)))
+				w.WriteHeader(http.StatusPartialContent)
+				fmt.Fprint(w, testContent[offset:])
+				return
+			}
+			fmt.Fprint(w, testContent)
+		}))
+
+		dir, cleanup := testDownloadDir(t)
+		fpath := filepath.Join(dir, "file")
+		if test.partial != "" {
+			if err := ioutil.WriteFile(fpath+partialSuffix, []byte(test.partial), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := newTestDownloader(1).Download(context.Background(), server.URL+"/file", fpath)
+		server.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		} else {
+			checkDownloaded(t, test.name, fpath, testContent)
+		}
+		if requests != test.requests {
+			t.Errorf("%s: expected %d request(s), got %d", test.name, test.requests, requests)
+		}
+		cleanup()
+	}
+}
+
+func TestDownloaderRetries(t *testing.T) {
+	tests := []struct {
+		name string
+		// statuses are returned for the first requests, the ones after
+		// them succeed
+		statuses []int
+		retries  int
+		requests int32
+		err      string
+	}{
+		{name: "success", requests: 1},
+		{name: "not found is permanent", statuses: []int{404}, retries: 3, requests: 1, err: "[404]"},
+		{name: "forbidden is permanent", statuses: []int{403}, retries: 3, requests: 1, err: "[403]"},
+		{name: "server error is retried", statuses: []int{500, 503}, retries: 3, requests: 3},
+		{name: "request timeout is retried", statuses: []int{408}, retries: 3, requests: 2},
+		{name: "too many requests is retried", statuses: []int{429}, retries: 3, requests: 2},
+		{name: "retries exhausted", statuses: []int{500, 500, 500}, retries: 2, requests: 3, err: "[500]"},
+		{name: "no retries", statuses: []int{502}, retries: 0, requests: 1, err: "[502]"},
+	}
+	for _, test := range tests {
+		var requests int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := int(atomic.AddInt32(&requests, 1))
+			if n <= len(test.statuses) {
+				w.WriteHeader(test.statuses[n-1])
+				return
+			}
+			fmt.Fprint(w, testContent)
+		}))
+
+		dir, cleanup := testDownloadDir(t)
+		fpath := filepath.Join(dir, "file")
+		err := newTestDownloader(test.retries).Download(context.Background(), server.URL+"/file", fpath)
+		server.Close()
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			} else {
+				checkDownloaded(t, test.name, fpath, testContent)
+			}
+		} else {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+			}
+			for _, p := range []string{fpath, fpath + partialSuffix} {
+				if _, err := os.Stat(p); !os.IsNotExist(err) {
+					t.Errorf("%s: %s left behind", test.name, filepath.Base(p))
+				}
+			}
+		}
+		if requests != test.requests {
+			t.Errorf("%s: expected %d request(s), got %d", test.name, test.requests, requests)
+		}
+		cleanup()
+	}
+}
+
+// roundTripperFunc serves responses without a server, e.g. with a body
+// shorter than announced, which net/http doesn't let a handler send
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestDownloaderShortBody(t *testing.T) {
+	dir, cleanup := testDownloadDir(t)
+	defer cleanup()
+	fpath := filepath.Join(dir, "file")
+
+	var requests int32
+	d := newTestDownloader(1)
+	d.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return &http.Response{
+			StatusCode:    http.StatusOK,
+			Status:        "200 OK",
+			ContentLength: int64(len(testContent)),
+			Body:          ioutil.NopCloser(strings.NewReader(testContent[:10])),
+			Request:       req,
+		}, nil
+	})
+	err := d.Download(context.Background(), "http://example.invalid/file", fpath)
+	if err == nil || !strings.Contains(err.Error(), fmt.Sprintf("got 10 of %d bytes", len(testContent))) {
+		t.Errorf("expected an incomplete download error, got %v", err)
+	}
+	if requests != 2 {
+		t.Errorf("expected the short download to be retried once, got %d request(s)", requests)
+	}
+	for _, p := range []string{fpath, fpath + partialSuffix} {
+		if _, err := os.Stat(p); !os.IsNotExist(err) {
+			t.Errorf("%s left behind", filepath.Base(p))
+		}
+	}
+}
+
+func TestDownloaderConcurrency(t *testing.T) {
+	const (
+		concurrency = 2
+		downloads   = 6
+	)
+	var (
+		mutex      sync.Mutex
+		running    int
+		maxRunning int
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		// give the other downloads time to start, if they may
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+		fmt.Fprint(w, testContent)
+	}))
+	defer server.Close()
+
+	dir, cleanup := testDownloadDir(t)
+	defer cleanup()
+
+	d := newTestDownloader(0)
+	d.Concurrency = concurrency
+	var wg sync.WaitGroup
+	errs := make(chan error, downloads)
+	for i := 0; i < downloads; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			name := fmt.Sprintf("file%d", i)
+			errs <- d.Download(context.Background(), server.URL+"/"+name, filepath.Join(dir, name))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	if maxRunning > concurrency {
+		t.Errorf("expected at most %d concurrent downloads, got %d", concurrency, maxRunning)
+	}
+	if maxRunning < concurrency {
+		t.Errorf("expected %d concurrent downloads, got only %d", concurrency, maxRunning)
+	}
+}
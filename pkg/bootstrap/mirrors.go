@@ -0,0 +1,122 @@
+package bootstrap
+
+import (
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultKubernetesMirror        = "https://dl.k8s.io/$VERSION/bin/linux/$ARCH/"
+	defaultKubernetesSystemdMirror = "https://raw.githubusercontent.com/kubernetes/kubernetes/$VERSION/build/rpms/"
+	defaultSocatMirror             = "https://raw.githubusercontent.com/andrew-d/static-binaries/530df977dd38ba3b4197878b34466d49fce69d8e/binaries/linux/$MACHINE/socat"
+	defaultFlatcarMirror           = "https://$CHANNEL.release.flatcar-linux.net/$ARCH-usr/current/"
+)
+
+// Mirrors holds the locations kube-spawn downloads its artifacts from.
+// They are URL templates, in which `$VERSION` is replaced with the
+// Kubernetes version, `$ARCH` with the architecture (e.g. `arm64`),
+// `$MACHINE` with its kernel name (e.g. `aarch64`) and `$CHANNEL` with
+// the Flatcar release channel.
+type Mirrors struct {
+	// Kubernetes is the directory of the kubelet, kubeadm and kubectl
+	// binaries and their checksums
+	Kubernetes string
+	// KubernetesSystemd is the directory of kubelet.service and
+	// 10-kubeadm.conf
+	KubernetesSystemd string
+	// Socat is the URL of the static socat binary
+	Socat string
+	// Flatcar is the directory of the Flatcar developer container image
+	// and its signature
+	Flatcar string
+}
+
+// DefaultMirrors are the upstream download locations
+var DefaultMirrors = Mirrors{
+	Kubernetes:        defaultKubernetesMirror,
+	KubernetesSystemd: defaultKubernetesSystemdMirror,
+	Socat:             defaultSocatMirror,
+	Flatcar:           defaultFlatcarMirror,
+}
+
+var mirrors = DefaultMirrors
+
+// SetMirrors configures the download locations. Empty fields keep their
+// upstream default.
+func SetMirrors(m Mirrors) error {
+	if m.Kubernetes == "" {
+		m.Kubernetes = DefaultMirrors.Kubernetes
+	}
+	if m.KubernetesSystemd == "" {
+		m.KubernetesSystemd = DefaultMirrors.KubernetesSystemd
+	}
+	if m.Socat == "" {
+		m.Socat = DefaultMirrors.Socat
+	}
+	if m.Flatcar == "" {
+		m.Flatcar = DefaultMirrors.Flatcar
+	}
+
+	for name, template := range map[string]string{
+		"kubernetes":         m.Kubernetes,
+		"kubernetes-systemd": m.KubernetesSystemd,
+		"socat":              m.Socat,
+		"flatcar":            m.Flatcar,
+	} {
+		u, err := url.Parse(expandURL(template, "v0.0.0", "stable"))
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.Errorf("invalid %s mirror %q: expected an absolute URL", name, template)
+		}
+	}
+	if !strings.Contains(m.Kubernetes, "$VERSION") {
+		return errors.Errorf("invalid kubernetes mirror %q: missing $VERSION", m.Kubernetes)
+	}
+	if !strings.Contains(m.KubernetesSystemd, "$VERSION") {
+		return errors.Errorf("invalid kubernetes-systemd mirror %q: missing $VERSION", m.KubernetesSystemd)
+	}
+
+	mirrors = m
+	flatcar := builtinBaseImages["flatcar"]
+	flatcar.URL = joinURL(m.Flatcar, flatcarImageFile)
+	flatcar.SignatureURL = flatcar.URL + ".sig"
+	return nil
+}
+
+// expandURL fills in the placeholders of a mirror URL template
+func expandURL(template, version, channel string) string {
+	return strings.NewReplacer(
+		"$VERSION", version,
+		"$ARCH", arch,
+		"$MACHINE", archMachines[arch],
+		"$CHANNEL", channel,
+	).Replace(template)
+}
+
+// joinURL appends a file name to a directory URL
+func joinURL(dir, file string) string {
+	return strings.TrimSuffix(dir, "/") + "/" + file
+}
+
+// proxyEnvVars are the proxy settings honoured by kube-spawn downloads
+// and passed on to the nodes
+var proxyEnvVars = []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY"}
+
+// ProxyEnvironment returns the proxy settings of the environment, keyed
+// by their upper case name. Lower case variables are used if the upper
+// case one is not set, like Go's http.ProxyFromEnvironment does.
+func ProxyEnvironment() map[string]string {
+	env := make(map[string]string)
+	for _, name := range proxyEnvVars {
+		value := os.Getenv(name)
+		if value == "" {
+			value = os.Getenv(strings.ToLower(name))
+		}
+		if value != "" {
+			env[name] = value
+		}
+	}
+	return env
+}
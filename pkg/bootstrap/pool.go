@@ -0,0 +1,557 @@
+package bootstrap
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/storage"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+const (
+	// minimum pool size should be around 2G, because Flatcar image is 1.6G.
+	minPoolSize int64 = 2 * 1024 * 1024 * 1024
+
+	// the pool needs some free space to stay usable, btrfs in particular
+	// fails in odd ways when full
+	minPoolFreeRatio float64 = 0.1
+
+	// Give 50% more space for each cloned image.
+	// NOTE: this is just a workaround, as how much space we should add more
+	// to the image might depend on estimations during run-time operations.
+	// In the long run, systemd itself should be able to reserve more space
+	// for the storage pool, every time when it pulls an image to store in
+	// the pool.
+	extraSizeRatio float64 = 0.5
+
+	// Only let the pool use this share of the free host space. We
+	// should reserve some unallocated free space for the whole host, as
+	// 100% usage of rootfs could badly affect the system's reliability.
+	maxHostUsageRatio float64 = 0.9
+)
+
+// PoolUsage describes the machine storage pool of systemd-machined
+type PoolUsage struct {
+	// ImageExists is true if the pool is backed by the loopback file
+	// machinesImage (older systemd versions or when /var/lib/machines
+	// isn't a separate filesystem)
+	ImageExists bool
+	// ImageAllocated is the allocated size of the loopback file in bytes
+	ImageAllocated int64
+	// Mounted is true if the pool filesystem is mounted on
+	// /var/lib/machines
+	Mounted bool
+	// Size and Free are the total and available bytes of the filesystem
+	// mounted on /var/lib/machines
+	Size uint64
+	Free uint64
+	// HostFree is the available space on the filesystem holding the
+	// pool image, i.e. the space the pool can still grow into
+	HostFree uint64
+	// Images lists the images in the pool, sorted by name
+	Images []PoolImage
+}
+
+// PoolImage is an image in the machine pool. Clones of an image share
+// data on btrfs, which is counted for every image in Usage.
+type PoolImage struct {
+	Name string
+	// Usage is the disk space used by the image in bytes
+	Usage int64
+}
+
+// Used returns the bytes used in the pool filesystem
+func (u *PoolUsage) Used() uint64 {
+	return u.Size - u.Free
+}
+
+// GetPoolUsage returns the size and usage of the machine pool. If
+// withImages is set, the images in the pool are listed with their disk
+// usage, which can take a while.
+func GetPoolUsage(withImages bool) (*PoolUsage, error) {
+	usage := &PoolUsage{}
+
+	exists, err := CheckPoolExists()
+	if err != nil {
+		return nil, err
+	}
+	usage.ImageExists = exists
+	if exists {
+		if usage.ImageAllocated, err = getAllocatedFileSize(machinesImage); err != nil {
+			return nil, err
+		}
+	}
+	usage.Mounted = checkMountpoint(machinesDir) == nil
+
+	if usage.Size, usage.Free, err = getVolSize(machinesDir); err != nil {
+		return nil, errors.Wrapf(err, "failed to get size of %s", machinesDir)
+	}
+	if usage.HostFree, err = getVolFreeSpace("/var/lib"); err != nil {
+		return nil, errors.Wrap(err, "failed to get free space of /var/lib")
+	}
+
+	if !withImages {
+		return usage, nil
+	}
+	images, err := machinectl.ListImages()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list machine images")
+	}
+	for _, image := range images {
+		imageUsage, err := ImageUsage(image.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to determine disk usage of image %q", image.Name)
+		}
+		usage.Images = append(usage.Images, PoolImage{Name: image.Name, Usage: imageUsage})
+	}
+	bases, err := storage.OverlayBases()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list base images extracted for the overlay storage driver")
+	}
+	for name, basePath := range bases {
+		baseUsage, err := fs.DiskUsage(basePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to determine disk usage of %s", basePath)
+		}
+		usage.Images = append(usage.Images, PoolImage{Name: name + " (overlay base)", Usage: baseUsage})
+	}
+	sort.Slice(usage.Images, func(i, j int) bool {
+		return usage.Images[i].Name < usage.Images[j].Name
+	})
+	return usage, nil
+}
+
+// ImageUsage returns the disk usage of an image in the pool, which
+// is either a raw disk image or a directory (or btrfs subvolume). For
+// machines created by the overlay storage driver, only the upper layer
+// is counted.
+func ImageUsage(name string) (int64, error) {
+	if storage.IsOverlayMachine(name) {
+		return fs.DiskUsage(storage.LayerPath(name))
+	}
+	for _, imagePath := range []string{path.Join(machinesDir, name+".raw"), path.Join(machinesDir, name)} {
+		if _, err := os.Lstat(imagePath); err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return 0, err
+		}
+		return fs.DiskUsage(imagePath)
+	}
+	return 0, errors.Errorf("image %q not found in %s", name, machinesDir)
+}
+
+// GetPoolSize returns the pool size needed to start the given number of
+// nodes from the base image
+func GetPoolSize(baseImageName string, nodes int) (int64, error) {
+	var poolSize, extraSize, biSize int64 // in bytes
+	var err error
+
+	// Select correct path to check disk space. On older systemd versions
+	// machinesImage is used.
+	p := machinesDir
+	poolExists, err := CheckPoolExists()
+	if err != nil {
+		return 0, err
+	} else if poolExists {
+		p = machinesImage
+
+		if poolSize, err = getAllocatedFileSize(machinesImage); err != nil {
+			return 0, err
+		}
+
+		extraSize = int64(float64(poolSize) * extraSizeRatio)
+	}
+
+	if biSize, err = ImageUsage(baseImageName); err != nil {
+		return 0, err
+	}
+	extraSize += int64(float64(biSize)*extraSizeRatio) * int64(nodes)
+
+	varDir, _ := path.Split(p)
+	freeVolSpace, err := getVolFreeSpace(varDir)
+	if err != nil {
+		return 0, err
+	}
+
+	if extraSize >= int64(float64(freeVolSpace)*maxHostUsageRatio) {
+		biSizeMB := int64(biSize / 1024 / 1024)
+		return 0, fmt.Errorf("not enough space on disk for %d nodes, Each node needs about %d MB, so in total you'll need about %d MB available.", nodes, biSizeMB, int64(nodes)*biSizeMB)
+	}
+
+	poolSize += extraSize
+
+	return poolSize, nil
+}
+
+func CheckPoolExists() (bool, error) {
+	if _, err := os.Stat(machinesImage); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		} else {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// PoolTooSmallError is returned by EnsurePoolSize if the pool is smaller
+// than required and may not be grown
+type PoolTooSmallError struct {
+	Size     int64
+	Required int64
+}
+
+func (e *PoolTooSmallError) Error() string {
+	return fmt.Sprintf("machine pool %s is too small: %s, need %s (grow it with `kube-spawn pool grow %s` or pass --grow-pool)",
+		machinesImage, utils.FormatBytes(e.Size), utils.FormatBytes(e.Required), FormatPoolSize(e.Required))
+}
+
+// FormatPoolSize formats a size in the format `pool grow` takes, rounded
+// up to full MiB
+func FormatPoolSize(size int64) string {
+	const mib = 1024 * 1024
+	return fmt.Sprintf("%dM", (size+mib-1)/mib)
+}
+
+// EnsurePoolSize checks that the machine pool is at least required bytes
+// large. A too small pool is grown if grow is set, otherwise a
+// *PoolTooSmallError is returned. Pools which are plain directories
+// have the size of the filesystem holding them and are not checked.
+func EnsurePoolSize(required int64, grow bool) error {
+	usage, err := GetPoolUsage(false)
+	if err != nil {
+		return err
+	}
+	if !usage.ImageExists || int64(usage.Size) >= required {
+		return nil
+	}
+	if !grow {
+		return &PoolTooSmallError{Size: int64(usage.Size), Required: required}
+	}
+	log.Printf("Growing machine pool from %s to %s ...", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(required))
+	return GrowPool(required)
+}
+
+// GrowPool grows the loopback file backing the machine pool and its
+// btrfs filesystem to size bytes. `machinectl set-limit` is tried first;
+// if machined cannot resize the pool (e.g. because it is in use), it is
+// unmounted, resized and mounted again, which requires that no machines
+// are running.
+func GrowPool(size int64) error {
+	usage, err := GetPoolUsage(false)
+	if err != nil {
+		return err
+	}
+	if !usage.ImageExists {
+		return errors.Errorf("machine pool %s is a directory, not a loopback image, it can only grow with the filesystem holding it", machinesDir)
+	}
+	if size <= int64(usage.Size) {
+		return errors.Errorf("machine pool is %s already, not growing it to %s", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(size))
+	}
+	growth := size - usage.ImageAllocated
+	if float64(growth) >= float64(usage.HostFree)*maxHostUsageRatio {
+		return errors.Errorf("not enough free space on the host to grow the machine pool to %s: %s free", utils.FormatBytes(size), utils.FormatBytes(int64(usage.HostFree)))
+	}
+
+	// machined can only resize the pool as long as it isn't in use
+	if err := setPoolLimit(size); err == nil && poolSizeAtLeast(size) {
+		return nil
+	}
+
+	if err := resizePoolOffline(size); err != nil {
+		return err
+	}
+	if err := runBtrfs("filesystem", "resize", "max", machinesDir); err != nil {
+		return errors.Wrap(err, "failed to grow the pool filesystem")
+	}
+	if err := runBtrfs("quota", "disable", machinesDir); err != nil {
+		return errors.Wrap(err, "failed to disable btrfs quota on the pool")
+	}
+	return nil
+}
+
+// ShrinkPool shrinks the btrfs filesystem of the machine pool and its
+// loopback file to size bytes. The pool has to keep some free space,
+// and no machines may be running.
+func ShrinkPool(size int64) error {
+	usage, err := GetPoolUsage(false)
+	if err != nil {
+		return err
+	}
+	if !usage.ImageExists {
+		return errors.Errorf("machine pool %s is a directory, not a loopback image, it cannot be shrunk", machinesDir)
+	}
+	if size >= int64(usage.Size) {
+		return errors.Errorf("machine pool is %s already, not shrinking it to %s", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(size))
+	}
+	if minSize := int64(float64(usage.Used()) / (1 - minPoolFreeRatio)); size < minSize || size < minPoolSize {
+		if minSize < minPoolSize {
+			minSize = minPoolSize
+		}
+		return errors.Errorf("machine pool uses %s, cannot shrink it below %s", utils.FormatBytes(int64(usage.Used())), utils.FormatBytes(minSize))
+	}
+	if err := ensureNoMachinesRunning(); err != nil {
+		return err
+	}
+
+	if !usage.Mounted {
+		if err := runMount(); err != nil {
+			return err
+		}
+	}
+	if err := runBtrfs("filesystem", "resize", strconv.FormatInt(size, 10), machinesDir); err != nil {
+		return errors.Wrap(err, "failed to shrink the pool filesystem")
+	}
+	return resizePoolOffline(size)
+}
+
+// CheckStatus is the result of a Check
+type CheckStatus string
+
+const (
+	CheckOK   CheckStatus = "ok"
+	CheckWarn CheckStatus = "warn"
+	CheckFail CheckStatus = "fail"
+)
+
+// Check is the result of a read-only check of the host, with a hint on
+// how to fix it if it didn't pass
+type Check struct {
+	Name    string      `json:"name"`
+	Status  CheckStatus `json:"status"`
+	Message string      `json:"message"`
+	Hint    string      `json:"hint,omitempty"`
+}
+
+// CheckPool checks that the machine pool is usable and large enough to
+// start the given number of nodes from the base image. Nothing is
+// changed.
+func CheckPool(baseImageName string, nodes int) []Check {
+	if _, err := os.Stat(machinesDir); os.IsNotExist(err) {
+		return []Check{{
+			Name:    "pool",
+			Status:  CheckOK,
+			Message: fmt.Sprintf("%s doesn't exist yet, systemd-machined creates it with the first image", machinesDir),
+		}}
+	}
+	usage, err := GetPoolUsage(false)
+	if err != nil {
+		return []Check{{
+			Name:    "pool",
+			Status:  CheckFail,
+			Message: fmt.Sprintf("failed to determine pool usage: %v", err),
+			Hint:    fmt.Sprintf("make sure %s exists and is readable", machinesDir),
+		}}
+	}
+
+	var checks []Check
+	if usage.ImageExists {
+		checks = append(checks, Check{
+			Name:    "pool backend",
+			Status:  CheckOK,
+			Message: fmt.Sprintf("loopback image %s, %s allocated", machinesImage, utils.FormatBytes(usage.ImageAllocated)),
+		})
+		if !usage.Mounted {
+			checks = append(checks, Check{
+				Name:    "pool mounted",
+				Status:  CheckFail,
+				Message: fmt.Sprintf("%s is not mounted on %s", machinesImage, machinesDir),
+				Hint:    fmt.Sprintf("mount it with `mount -t btrfs -o loop %s %s`", machinesImage, machinesDir),
+			})
+			return checks
+		}
+		checks = append(checks, Check{Name: "pool mounted", Status: CheckOK, Message: fmt.Sprintf("mounted on %s", machinesDir)})
+	} else {
+		checks = append(checks, Check{
+			Name:    "pool backend",
+			Status:  CheckOK,
+			Message: fmt.Sprintf("directory %s, limited by the filesystem holding it", machinesDir),
+		})
+	}
+
+	poolFree := Check{
+		Name:    "pool free space",
+		Status:  CheckOK,
+		Message: fmt.Sprintf("%s of %s free", utils.FormatBytes(int64(usage.Free)), utils.FormatBytes(int64(usage.Size))),
+	}
+	if float64(usage.Free) < float64(usage.Size)*minPoolFreeRatio {
+		poolFree.Status = CheckWarn
+		if usage.ImageExists {
+			poolFree.Hint = "grow the pool with `kube-spawn pool grow SIZE` or remove unused images with `machinectl remove`"
+		} else {
+			poolFree.Hint = "free some space or remove unused images with `machinectl remove`"
+		}
+	}
+	checks = append(checks, poolFree)
+
+	hostFree := Check{
+		Name:    "host free space",
+		Status:  CheckOK,
+		Message: fmt.Sprintf("%s free on /var/lib", utils.FormatBytes(int64(usage.HostFree))),
+	}
+	if int64(usage.HostFree) < minPoolSize {
+		hostFree.Status = CheckWarn
+		hostFree.Hint = "free some space on the host filesystem holding /var/lib"
+	}
+	checks = append(checks, hostFree)
+
+	startCheck := Check{Name: fmt.Sprintf("pool size for %d nodes", nodes), Status: CheckOK}
+	var required int64
+	if machinectl.ImageExists(baseImageName) {
+		if required, err = GetPoolSize(baseImageName, nodes); err != nil {
+			startCheck.Status = CheckFail
+			startCheck.Message = err.Error()
+			startCheck.Hint = "free some space on the host or start fewer nodes"
+			return append(checks, startCheck)
+		}
+	} else {
+		// the base image is downloaded first, which needs minPoolSize
+		required = minPoolSize
+	}
+	if usage.ImageExists && int64(usage.Size) < required {
+		startCheck.Status = CheckFail
+		startCheck.Message = fmt.Sprintf("pool is %s, need %s", utils.FormatBytes(int64(usage.Size)), utils.FormatBytes(required))
+		startCheck.Hint = fmt.Sprintf("grow it with `kube-spawn pool grow %s` or pass --grow-pool to start", FormatPoolSize(required))
+	} else {
+		startCheck.Message = fmt.Sprintf("enough space for %d nodes of image %s", nodes, baseImageName)
+	}
+	return append(checks, startCheck)
+}
+
+func poolSizeAtLeast(size int64) bool {
+	total, _, err := getVolSize(machinesDir)
+	return err == nil && int64(total) >= size
+}
+
+func ensureNoMachinesRunning() error {
+	machines, err := machinectl.List()
+	if err != nil {
+		return errors.Wrap(err, "failed to list running machines")
+	}
+	if len(machines) > 0 {
+		var names []string
+		for _, machine := range machines {
+			names = append(names, machine.Name)
+		}
+		return errors.Errorf("cannot resize the machine pool while machines are running, stop them first: %s", strings.Join(names, " "))
+	}
+	return nil
+}
+
+// resizePoolOffline unmounts the pool, resizes its loopback file and
+// mounts it again
+func resizePoolOffline(size int64) error {
+	if err := ensureNoMachinesRunning(); err != nil {
+		return err
+	}
+	if checkMountpoint(machinesDir) == nil {
+		if err := syscall.Unmount(machinesDir, 0); err != nil {
+			return errors.Wrapf(err, "failed to unmount %s (is it in use?)", machinesDir)
+		}
+	}
+	if err := os.Truncate(machinesImage, size); err != nil {
+		// mount the pool again in its old size
+		if mountErr := runMount(); mountErr != nil {
+			log.Printf("Failed to mount the machine pool again: %v", mountErr)
+		}
+		return errors.Wrapf(err, "failed to resize %s", machinesImage)
+	}
+	return runMount()
+}
+
+func setPoolLimit(poolSize int64) error {
+	var cmdPath string
+	var err error
+
+	if cmdPath, err = exec.LookPath("machinectl"); err != nil {
+		return fmt.Errorf("machinectl not installed: %s", err)
+	}
+
+	args := []string{
+		cmdPath,
+		"set-limit",
+		strconv.FormatInt(poolSize, 10),
+	}
+
+	cmd := exec.Cmd{
+		Path:   cmdPath,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if err := cmd.Run(); err != nil {
+		// We do expect this might occur. E.g. if they have
+		// already started using the pool
+		return fmt.Errorf("error running machinectl: %s", err)
+	}
+
+	return nil
+}
+
+func runMount() error {
+	var cmdPath string
+	var err error
+
+	if cmdPath, err = exec.LookPath("mount"); err != nil {
+		return fmt.Errorf("Cannot find mount command: %s", err)
+	}
+
+	args := []string{
+		cmdPath,
+		"-t",
+		"btrfs",
+		"-o",
+		"loop",
+		machinesImage,
+		machinesDir,
+	}
+
+	cmd := exec.Cmd{
+		Path:   cmdPath,
+		Args:   args,
+		Env:    os.Environ(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running mount: %s", err)
+	}
+
+	return nil
+}
+
+func runBtrfs(args ...string) error {
+	cmdPath, err := exec.LookPath("btrfs")
+	if err != nil {
+		return fmt.Errorf("btrfs not installed: %s", err)
+	}
+
+	cmd := exec.Cmd{
+		Path:   cmdPath,
+		Args:   append([]string{cmdPath}, args...),
+		Env:    os.Environ(),
+		Stdout: os.Stdout,
+		Stderr: os.Stderr,
+	}
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("error running btrfs %s: %s", strings.Join(args, " "), err)
+	}
+
+	return nil
+}
@@ -23,6 +23,8 @@ import (
 	"path/filepath"
 	"syscall"
 	"unsafe"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
 )
 
 const (
@@ -47,6 +49,12 @@ func PathSupportsOverlay(path string) error {
 		return fmt.Errorf("cannot create directory %q", path)
 	}
 
+	return pathSupportsOverlay(path)
+}
+
+// pathSupportsOverlay is the read-only part of PathSupportsOverlay,
+// checking the filesystem of the existing directory path
+func pathSupportsOverlay(path string) error {
 	var data syscall.Statfs_t
 	if err := syscall.Statfs(path, &data); err != nil {
 		return fmt.Errorf("cannot statfs %q", path)
@@ -128,19 +136,22 @@ func getVolFreeSpace(volPath string) (uint64, error) {
 	return freeSpace, nil
 }
 
+// get total and free size of volume mounted on volPath (in bytes)
+func getVolSize(volPath string) (uint64, uint64, error) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(volPath, &stat); err != nil {
+		return 0, 0, err
+	}
+
+	return stat.Blocks * uint64(stat.Bsize), stat.Bavail * uint64(stat.Bsize), nil
+}
+
 // get allocated size of file (in bytes)
 func getAllocatedFileSize(filename string) (int64, error) {
 	fi, err := os.Stat(filename)
 	if err != nil {
 		return 0, err
 	}
-
-	stat_t, ok := fi.Sys().(*syscall.Stat_t)
-	if !ok {
-		return 0, fmt.Errorf("cannot determine allocated filesize")
-	}
-
-	// stat(2) returns allocated filesize in blocks, each of which is
-	// a fixed 512 bytes
-	return (stat_t.Blocks * 512), nil
+	return fs.AllocatedSize(fi)
 }
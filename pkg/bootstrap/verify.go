@@ -0,0 +1,141 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package bootstrap
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// DefaultFlatcarSigningKeyPath is where the Flatcar image signing key
+	// is expected, see FlatcarSigningKeyURL
+	DefaultFlatcarSigningKeyPath = "/etc/kube-spawn/keys/flatcar-image-signing-key.asc"
+	// FlatcarSigningKeyURL is where the Flatcar project publishes its
+	// image signing key
+	FlatcarSigningKeyURL = "https://www.flatcar-linux.org/security/image-signing-key/Flatcar_Image_Signing_Key.asc"
+)
+
+// ImageVerification holds the options for verifying downloaded base
+// images
+type ImageVerification struct {
+	// SkipVerify disables the signature verification
+	SkipVerify bool
+	// SigningKeyPath overrides the signing key of the base image. The
+	// file may contain an armored or binary OpenPGP public key ring.
+	SigningKeyPath string
+	// DownloadDir is where images are downloaded to before they are
+	// verified and imported
+	DownloadDir string
+}
+
+// downloadVerified downloads the image and its signature, verifies the
+// signature and imports the image. Nothing is imported if the signature
+// doesn't match.
+func (b *BaseImage) downloadVerified(ctx context.Context, channelName string, verification *ImageVerification) error {
+	if b.SignatureURL == "" {
+		return errors.Errorf("no signature available for base image %q, use --insecure-skip-image-verify to use it unverified", b.Name)
+	}
+
+	keyPath := verification.SigningKeyPath
+	if keyPath == "" {
+		keyPath = b.SigningKeyPath
+	}
+	keyRing, err := readKeyRing(keyPath)
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) && keyPath == DefaultFlatcarSigningKeyPath {
+			return errors.Errorf("Flatcar image signing key not found at %s, download it from %s (and check its fingerprint) or use --image-signing-key", keyPath, FlatcarSigningKeyURL)
+		}
+		return err
+	}
+
+	imageURL := b.channelURL(b.URL, channelName)
+	imagePath := path.Join(verification.DownloadDir, b.Name, path.Base(imageURL))
+	sigPath := imagePath + ".sig"
+	// The downloads are only kept until the image is imported
+	defer os.Remove(imagePath)
+	defer os.Remove(sigPath)
+
+	log.Printf("downloading %s ...", imageURL)
+	if err := Download(ctx, imageURL, imagePath); err != nil {
+		return errors.Wrapf(err, "failed to download %s", imageURL)
+	}
+	if err := Download(ctx, b.channelURL(b.SignatureURL, channelName), sigPath); err != nil {
+		return errors.Wrapf(err, "failed to download signature of %s", imageURL)
+	}
+
+	if err := verifySignature(keyRing, imagePath, sigPath); err != nil {
+		return errors.Wrapf(err, "refusing to use %s image downloaded from %s", b.Name, imageURL)
+	}
+	log.Printf("signature of %s verified with %s", path.Base(imageURL), keyPath)
+
+	return b.importImage(imagePath)
+}
+
+func readKeyRing(keyPath string) (openpgp.EntityList, error) {
+	f, err := os.Open(keyPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open signing key")
+	}
+	defer f.Close()
+
+	keyRing, err := openpgp.ReadArmoredKeyRing(f)
+	if err == nil {
+		return keyRing, nil
+	}
+	// Not armored, try again with a binary key ring
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	keyRing, err = openpgp.ReadKeyRing(f)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read signing key %q", keyPath)
+	}
+	return keyRing, nil
+}
+
+func verifySignature(keyRing openpgp.EntityList, filePath, sigPath string) error {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sig, err := os.Open(sigPath)
+	if err != nil {
+		return err
+	}
+	defer sig.Close()
+
+	if _, err := openpgp.CheckDetachedSignature(keyRing, f, sig); err != nil {
+		// Some signatures are published armored
+		if _, err := f.Seek(0, 0); err != nil {
+			return err
+		}
+		if _, err := sig.Seek(0, 0); err != nil {
+			return err
+		}
+		if _, armoredErr := openpgp.CheckArmoredDetachedSignature(keyRing, f, sig); armoredErr != nil {
+			return errors.Wrap(err, "signature verification failed")
+		}
+	}
+	return nil
+}
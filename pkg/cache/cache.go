@@ -1,13 +1,19 @@
 package cache
 
+import "github.com/pkg/errors"
+
 type Cache struct {
 	dir string
 }
 
 func New(dir string) (*Cache, error) {
-	return &Cache{
+	c := &Cache{
 		dir: dir,
-	}, nil
+	}
+	if err := c.migrate(); err != nil {
+		return nil, errors.Wrap(err, "failed to migrate cached files to the current layout")
+	}
+	return c, nil
 }
 
 func (c *Cache) Dir() string {
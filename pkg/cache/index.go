@@ -0,0 +1,302 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/lock"
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+const (
+	blobsDir      = "blobs"
+	indexName     = "index.json"
+	indexLockName = "index.lock"
+	// other kube-spawn processes only hold the index lock for a
+	// moment, wait for them
+	indexLockTimeout = 30 * time.Second
+)
+
+// Artifact types
+const (
+	ArtifactKubernetes = "kubernetes"
+	ArtifactSocat      = "socat"
+)
+
+// Entry describes a file in the cache
+type Entry struct {
+	// Artifact is the type of the artifact the file belongs to, e.g.
+	// ArtifactKubernetes
+	Artifact string `json:"artifact"`
+	// Version of the artifact, e.g. the Kubernetes version
+	Version string `json:"version,omitempty"`
+	Arch    string `json:"arch,omitempty"`
+	// Path of the file relative to the cache dir
+	Path string `json:"path"`
+	// URL the file was downloaded from
+	URL       string `json:"url,omitempty"`
+	Algorithm string `json:"algorithm"`
+	Digest    string `json:"digest"`
+	// Verified is true if the digest was checked against one published
+	// upstream, false if it was only computed after the download
+	Verified bool      `json:"verified"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"lastUsed"`
+	// Blob is the path of the content addressed copy of the file
+	// relative to the cache dir, see Record
+	Blob string `json:"blob,omitempty"`
+}
+
+type index struct {
+	Entries map[string]*Entry `json:"entries"`
+}
+
+// indexMutex serializes index updates within kube-spawn, the index lock
+// file only works between processes
+var indexMutex sync.Mutex
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.dir, indexName)
+}
+
+// FilePath returns the absolute path of a file in the cache
+func (c *Cache) FilePath(relPath string) string {
+	return filepath.Join(c.dir, relPath)
+}
+
+func (c *Cache) readIndex() (*index, error) {
+	idx := &index{Entries: make(map[string]*Entry)}
+	content, err := ioutil.ReadFile(c.indexPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return idx, nil
+		}
+		return nil, err
+	}
+	if err := json.Unmarshal(content, idx); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse cache index %q", c.indexPath())
+	}
+	if idx.Entries == nil {
+		idx.Entries = make(map[string]*Entry)
+	}
+	return idx, nil
+}
+
+// updateIndex runs update on the current index with the index locked
+// and writes the index back atomically if update succeeds
+func (c *Cache) updateIndex(update func(idx *index) error) error {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	if err := os.MkdirAll(c.dir, 0755); err != nil {
+		return err
+	}
+	indexLock, err := lock.Acquire(filepath.Join(c.dir, indexLockName), "cache index", indexLockTimeout)
+	if err != nil {
+		return err
+	}
+	defer indexLock.Release()
+
+	idx, err := c.readIndex()
+	if err != nil {
+		return err
+	}
+	if err := update(idx); err != nil {
+		return err
+	}
+
+	content, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.indexPath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, c.indexPath()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// Entries returns all files in the cache index, sorted by path
+func (c *Cache) Entries() ([]*Entry, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	idx, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, entry := range idx.Entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Path < entries[j].Path
+	})
+	return entries, nil
+}
+
+// Entry returns the index entry of the file at relPath or nil if the
+// file is not in the index
+func (c *Cache) Entry(relPath string) (*Entry, error) {
+	indexMutex.Lock()
+	defer indexMutex.Unlock()
+
+	idx, err := c.readIndex()
+	if err != nil {
+		return nil, err
+	}
+	return idx.Entries[relPath], nil
+}
+
+// Record adds the file of entry to the index or updates it. The size is
+// taken from the file and it is marked as used now.
+//
+// The file is stored by its SHA-256 digest in the blobs dir of the cache
+// and its path becomes a hardlink of the blob, so that files with the
+// same content, e.g. of different Kubernetes versions, are only stored
+// once. Cached files can be linked elsewhere with fs.LinkOrCopy and must
+// not be modified in place.
+func (c *Cache) Record(entry *Entry) error {
+	info, err := os.Stat(c.FilePath(entry.Path))
+	if err != nil {
+		return err
+	}
+	entry.Size = info.Size()
+	entry.LastUsed = time.Now().UTC()
+	return c.updateIndex(func(idx *index) error {
+		if err := c.storeBlob(entry); err != nil {
+			return errors.Wrapf(err, "failed to store %s by digest", entry.Path)
+		}
+		idx.Entries[entry.Path] = entry
+		return nil
+	})
+}
+
+// storeBlob links the file of entry into the blobs dir, or, if a blob
+// with the same content exists already, replaces the file with a link
+// to that blob
+func (c *Cache) storeBlob(entry *Entry) error {
+	filePath := c.FilePath(entry.Path)
+	digest := entry.Digest
+	if entry.Algorithm != utils.SHA256 {
+		var err error
+		if digest, err = utils.FileDigest(filePath, utils.SHA256); err != nil {
+			return err
+		}
+	}
+	entry.Blob = filepath.Join(blobsDir, utils.SHA256, digest)
+	blobPath := c.FilePath(entry.Blob)
+
+	if err := os.MkdirAll(filepath.Dir(blobPath), 0755); err != nil {
+		return err
+	}
+	err := os.Link(filePath, blobPath)
+	if err == nil || !os.IsExist(err) {
+		return err
+	}
+	if sameFile(filePath, blobPath) {
+		return nil
+	}
+	if utils.VerifyFileDigest(blobPath, utils.SHA256, digest) != nil {
+		// replace the corrupt blob with the new file
+		return fs.LinkOrCopy(filePath, blobPath)
+	}
+	return fs.LinkOrCopy(blobPath, filePath)
+}
+
+func sameFile(a, b string) bool {
+	infoA, errA := os.Stat(a)
+	infoB, errB := os.Stat(b)
+	return errA == nil && errB == nil && os.SameFile(infoA, infoB)
+}
+
+// Touch marks the given files as used now
+func (c *Cache) Touch(relPaths ...string) error {
+	now := time.Now().UTC()
+	return c.updateIndex(func(idx *index) error {
+		for _, relPath := range relPaths {
+			if entry, ok := idx.Entries[relPath]; ok {
+				entry.LastUsed = now
+			}
+		}
+		return nil
+	})
+}
+
+// Verify checks that the file of entry still has the recorded size and
+// digest
+func (c *Cache) Verify(entry *Entry) error {
+	filePath := c.FilePath(entry.Path)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != entry.Size {
+		return errors.Errorf("size mismatch for %s: expected %d bytes, got %d", filePath, entry.Size, info.Size())
+	}
+	return utils.VerifyFileDigest(filePath, entry.Algorithm, entry.Digest)
+}
+
+// Remove deletes the files of the given entries and drops them from the
+// index. Blobs no longer referenced and directories left empty are
+// removed as well.
+func (c *Cache) Remove(entries ...*Entry) error {
+	var removeErr error
+	err := c.updateIndex(func(idx *index) error {
+		for _, entry := range entries {
+			filePath := c.FilePath(entry.Path)
+			if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+				// keep the entry of the file which is still there
+				if removeErr == nil {
+					removeErr = err
+				}
+				continue
+			}
+			delete(idx.Entries, entry.Path)
+			c.removeEmptyParents(filePath)
+		}
+
+		referenced := make(map[string]bool)
+		for _, entry := range idx.Entries {
+			referenced[entry.Blob] = true
+		}
+		for _, entry := range entries {
+			if entry.Blob == "" || referenced[entry.Blob] {
+				continue
+			}
+			blobPath := c.FilePath(entry.Blob)
+			if err := os.Remove(blobPath); err != nil && !os.IsNotExist(err) && removeErr == nil {
+				removeErr = err
+			}
+			c.removeEmptyParents(blobPath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return removeErr
+}
+
+// removeEmptyParents removes the parent directories of filePath inside
+// the cache dir until one is not empty
+func (c *Cache) removeEmptyParents(filePath string) {
+	for dir := filepath.Dir(filePath); dir != filepath.Clean(c.dir); dir = filepath.Dir(dir) {
+		// fails if the directory is not empty
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
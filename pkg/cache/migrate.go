@@ -0,0 +1,241 @@
+package cache
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils"
+)
+
+const (
+	// legacyArch is the architecture of the files cached before
+	// kube-spawn supported other architectures
+	legacyArch = "amd64"
+	// legacyManifestName is the file the digests of the Kubernetes files
+	// of a version were recorded in before the index
+	legacyManifestName = "manifest.json"
+)
+
+// legacyManifest is the content of a legacyManifestName file, its
+// entries are keyed by file name
+type legacyManifest struct {
+	Files map[string]*Entry `json:"files"`
+}
+
+// migrate moves files cached by older kube-spawn versions to the current
+// layout
+//
+//	kubernetes/<version>/<file>  ->  kubernetes/amd64/<version>/<file>
+//	socat                        ->  socat/amd64/socat
+//	socat-<arch>                 ->  socat/<arch>/socat
+//
+// and adds cached files which are not in the index yet, so that they are
+// reused instead of downloaded again. The digests of files listed in a
+// manifest of an older version are taken from there, the others are
+// computed from the file, so such Kubernetes binaries are still downloaded
+// again to verify them against the published checksums.
+func (c *Cache) migrate() error {
+	if err := c.moveLegacyKubernetesDirs(); err != nil {
+		return err
+	}
+	if err := c.moveLegacySocat(); err != nil {
+		return err
+	}
+	if err := c.importLegacyManifests(); err != nil {
+		return err
+	}
+	return c.adoptUnindexedFiles()
+}
+
+func (c *Cache) moveLegacyKubernetesDirs() error {
+	dir := c.FilePath(ArtifactKubernetes)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		// Kubernetes versions start with "v", architectures don't
+		if !info.IsDir() || !strings.HasPrefix(info.Name(), "v") {
+			continue
+		}
+		oldPath := filepath.Join(dir, info.Name())
+		newPath := filepath.Join(dir, legacyArch, info.Name())
+		if err := moveLegacyPath(oldPath, newPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) moveLegacySocat() error {
+	socatPath := c.FilePath(ArtifactSocat)
+	// socat has to become a directory, so move the file aside first
+	tmpPath := socatPath + ".legacy"
+	if info, err := os.Lstat(socatPath); err == nil && info.Mode().IsRegular() {
+		if err := os.Rename(socatPath, tmpPath); err != nil {
+			return errors.Wrapf(err, "failed to move %s", socatPath)
+		}
+	}
+	if _, err := os.Lstat(tmpPath); err == nil {
+		if err := moveLegacyPath(tmpPath, filepath.Join(socatPath, legacyArch, "socat")); err != nil {
+			return err
+		}
+	}
+
+	legacyPaths, err := filepath.Glob(c.FilePath(ArtifactSocat + "-*"))
+	if err != nil {
+		return err
+	}
+	for _, oldPath := range legacyPaths {
+		arch := strings.TrimPrefix(filepath.Base(oldPath), ArtifactSocat+"-")
+		if err := moveLegacyPath(oldPath, filepath.Join(socatPath, arch, "socat")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveLegacyPath moves oldPath to newPath, unless newPath exists already,
+// then oldPath is outdated and removed
+func moveLegacyPath(oldPath, newPath string) error {
+	if _, err := os.Lstat(newPath); err == nil {
+		return os.RemoveAll(oldPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return errors.Wrapf(err, "failed to move %s to %s", oldPath, newPath)
+	}
+	return nil
+}
+
+// importLegacyManifests adds the files listed in the manifests in
+// kubernetes/<arch>/<version> to the index, if they still match the
+// recorded digest, and removes the manifests
+func (c *Cache) importLegacyManifests() error {
+	manifestPaths, err := filepath.Glob(c.FilePath(filepath.Join(ArtifactKubernetes, "*", "*", legacyManifestName)))
+	if err != nil {
+		return err
+	}
+	for _, manifestPath := range manifestPaths {
+		content, err := ioutil.ReadFile(manifestPath)
+		if err != nil {
+			return err
+		}
+		manifest := &legacyManifest{}
+		// the files of a broken manifest are added without it
+		if json.Unmarshal(content, manifest) == nil {
+			if err := c.importLegacyManifest(filepath.Dir(manifestPath), manifest); err != nil {
+				return err
+			}
+		}
+		if err := os.Remove(manifestPath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Cache) importLegacyManifest(versionDir string, manifest *legacyManifest) error {
+	relDir, err := filepath.Rel(c.dir, versionDir)
+	if err != nil {
+		return err
+	}
+	parts := strings.Split(relDir, string(filepath.Separator))
+	for name, entry := range manifest.Files {
+		if entry == nil || name != filepath.Base(name) {
+			continue
+		}
+		entry.Artifact = ArtifactKubernetes
+		entry.Arch = parts[1]
+		entry.Version = parts[2]
+		entry.Path = filepath.Join(relDir, name)
+		filePath := c.FilePath(entry.Path)
+		if !isCachedFile(filePath) || utils.VerifyFileDigest(filePath, entry.Algorithm, entry.Digest) != nil {
+			continue
+		}
+		known, err := c.Entry(entry.Path)
+		if err != nil {
+			return err
+		}
+		if known != nil {
+			continue
+		}
+		if err := c.Record(entry); err != nil {
+			return errors.Wrapf(err, "failed to add %s to the cache index", entry.Path)
+		}
+	}
+	return nil
+}
+
+// adoptUnindexedFiles records the files in kubernetes/<arch>/<version>
+// and socat/<arch> which are missing in the index
+func (c *Cache) adoptUnindexedFiles() error {
+	var candidates []*Entry
+	for _, artifact := range []string{ArtifactKubernetes, ArtifactSocat} {
+		pattern := filepath.Join(artifact, "*", "*")
+		if artifact == ArtifactKubernetes {
+			pattern = filepath.Join(artifact, "*", "*", "*")
+		}
+		filePaths, err := filepath.Glob(c.FilePath(pattern))
+		if err != nil {
+			return err
+		}
+		for _, filePath := range filePaths {
+			relPath, err := filepath.Rel(c.dir, filePath)
+			if err != nil {
+				return err
+			}
+			parts := strings.Split(relPath, string(filepath.Separator))
+			entry := &Entry{Artifact: artifact, Arch: parts[1], Path: relPath}
+			if artifact == ArtifactKubernetes {
+				entry.Version = parts[2]
+			}
+			candidates = append(candidates, entry)
+		}
+	}
+	for _, entry := range candidates {
+		if !isCachedFile(c.FilePath(entry.Path)) {
+			continue
+		}
+		known, err := c.Entry(entry.Path)
+		if err != nil {
+			return err
+		}
+		if known != nil {
+			continue
+		}
+		entry.Algorithm = utils.SHA256
+		if entry.Digest, err = utils.FileDigest(c.FilePath(entry.Path), entry.Algorithm); err != nil {
+			return err
+		}
+		if err := c.Record(entry); err != nil {
+			return errors.Wrapf(err, "failed to add %s to the cache index", entry.Path)
+		}
+	}
+	return nil
+}
+
+// isCachedFile returns false for anything but complete regular files,
+// e.g. for downloads still in progress
+func isCachedFile(filePath string) bool {
+	info, err := os.Lstat(filePath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	for _, suffix := range []string{".part", ".tmp", ".kube-spawn-tmp"} {
+		if strings.HasSuffix(filePath, suffix) {
+			return false
+		}
+	}
+	return true
+}
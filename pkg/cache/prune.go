@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"sort"
+	"time"
+
+	"github.com/Masterminds/semver"
+)
+
+// PruneGracePeriod is how long artifacts are kept after their last use
+// in any case, they could belong to a cluster which is being created
+const PruneGracePeriod = time.Hour
+
+// Artifact groups the files of one artifact in the cache, e.g. the
+// Kubernetes binaries of one version and architecture
+type Artifact struct {
+	Name    string
+	Version string
+	Arch    string
+	Entries []*Entry
+}
+
+// Size returns the total size of the files of the artifact
+func (a *Artifact) Size() int64 {
+	var size int64
+	for _, entry := range a.Entries {
+		size += entry.Size
+	}
+	return size
+}
+
+// LastUsed returns when a file of the artifact was last used
+func (a *Artifact) LastUsed() time.Time {
+	var lastUsed time.Time
+	for _, entry := range a.Entries {
+		if entry.LastUsed.After(lastUsed) {
+			lastUsed = entry.LastUsed
+		}
+	}
+	return lastUsed
+}
+
+// Artifacts returns the artifacts in the cache index, sorted by name,
+// architecture and version
+func (c *Cache) Artifacts() ([]*Artifact, error) {
+	entries, err := c.Entries()
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[[3]string]*Artifact)
+	var artifacts []*Artifact
+	for _, entry := range entries {
+		key := [3]string{entry.Artifact, entry.Arch, entry.Version}
+		artifact, ok := byKey[key]
+		if !ok {
+			artifact = &Artifact{Name: entry.Artifact, Version: entry.Version, Arch: entry.Arch}
+			byKey[key] = artifact
+			artifacts = append(artifacts, artifact)
+		}
+		artifact.Entries = append(artifact.Entries, entry)
+	}
+	sort.Slice(artifacts, func(i, j int) bool {
+		a, b := artifacts[i], artifacts[j]
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		if a.Arch != b.Arch {
+			return a.Arch < b.Arch
+		}
+		return versionLess(a.Version, b.Version)
+	})
+	return artifacts, nil
+}
+
+// versionLess compares semantic versions, falling back to comparing
+// strings for anything else
+func versionLess(a, b string) bool {
+	va, errA := semver.NewVersion(a)
+	vb, errB := semver.NewVersion(b)
+	if errA != nil || errB != nil {
+		return a < b
+	}
+	return va.LessThan(vb)
+}
+
+// PruneSettings select the artifacts Prune removes
+type PruneSettings struct {
+	// KeepVersions is the number of newest versions of every artifact
+	// and architecture to keep. Zero means no version is kept for being
+	// new.
+	KeepVersions int
+	// OlderThan limits pruning to artifacts not used for at least the
+	// given duration. Zero means any age.
+	OlderThan time.Duration
+	// InUse reports whether an artifact is used by an existing cluster,
+	// those are never removed
+	InUse func(artifact *Artifact) bool
+	// DryRun only reports what would be removed
+	DryRun bool
+}
+
+// Prune removes the artifacts selected by pruneSettings. It returns the
+// removed artifacts and the selected ones which were kept because they
+// are in use.
+func (c *Cache) Prune(pruneSettings *PruneSettings) ([]*Artifact, []*Artifact, error) {
+	artifacts, err := c.Artifacts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// artifacts are sorted by version, so the newest versions of a
+	// group come last
+	kept := make(map[*Artifact]bool)
+	counts := make(map[[2]string]int)
+	for i := len(artifacts) - 1; i >= 0; i-- {
+		key := [2]string{artifacts[i].Name, artifacts[i].Arch}
+		if counts[key] < pruneSettings.KeepVersions {
+			kept[artifacts[i]] = true
+		}
+		counts[key]++
+	}
+
+	now := time.Now()
+	var removed, inUse []*Artifact
+	for _, artifact := range artifacts {
+		if kept[artifact] {
+			continue
+		}
+		unused := now.Sub(artifact.LastUsed())
+		if unused < PruneGracePeriod || unused < pruneSettings.OlderThan {
+			continue
+		}
+		if pruneSettings.InUse != nil && pruneSettings.InUse(artifact) {
+			inUse = append(inUse, artifact)
+			continue
+		}
+		if !pruneSettings.DryRun {
+			if err := c.Remove(artifact.Entries...); err != nil {
+				return removed, inUse, err
+			}
+		}
+		removed = append(removed, artifact)
+	}
+	return removed, inUse, nil
+}
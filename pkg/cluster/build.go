@@ -0,0 +1,129 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/multiprint"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+// BuildSettings holds the options for building Kubernetes from source
+type BuildSettings struct {
+	KubernetesSourceDir string
+	// HyperkubeImage is the image to build and push with the
+	// control plane components. No image is built if empty.
+	HyperkubeImage string
+}
+
+// BuildKubernetes builds the binaries required by Create in the given
+// Kubernetes source dir. If the source dir was built with Docker before
+// (`build/run.sh make`) or Go isn't installed, the build runs in Docker
+// as well, so that KubernetesSourceBinaryDir finds the new binaries.
+//
+// If a hyperkube image is given, the hyperkube binary is built too and
+// an image with it is built with `cluster/images/hyperkube`, tagged with
+// the given name and pushed.
+func BuildKubernetes(ctx context.Context, buildSettings *BuildSettings) error {
+	sourceDir := buildSettings.KubernetesSourceDir
+	if exists, err := fs.PathExists(path.Join(sourceDir, "build/run.sh")); err != nil {
+		return err
+	} else if !exists {
+		return errors.Errorf("%q doesn't look like a Kubernetes source dir", sourceDir)
+	}
+
+	dockerized, err := fs.PathExists(path.Join(sourceDir, "_output/dockerized"))
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("go"); err != nil {
+		dockerized = true
+	}
+
+	targets := []string{"cmd/kubelet", "cmd/kubeadm", "cmd/kubectl"}
+	if buildSettings.HyperkubeImage != "" {
+		targets = append(targets, "cmd/hyperkube")
+	}
+	makeArgs := []string{"make", fmt.Sprintf("WHAT=%s", strings.Join(targets, " "))}
+	if hostArch, err := bootstrap.HostArch(); err != nil || hostArch != bootstrap.Arch() {
+		makeArgs = append(makeArgs, fmt.Sprintf("KUBE_BUILD_PLATFORMS=linux/%s", bootstrap.Arch()))
+	}
+	if dockerized {
+		makeArgs = append([]string{"build/run.sh"}, makeArgs...)
+	}
+
+	multiPrinter := multiprint.New(ctx)
+	multiPrinter.RunPrintLoop()
+	defer multiPrinter.Close()
+
+	log.Printf("Building Kubernetes in %s (%s) ...", sourceDir, strings.Join(makeArgs, " "))
+	if err := runBuildCommand(ctx, sourceDir, multiPrinter.NewWriter("build "), makeArgs...); err != nil {
+		return errors.Wrap(err, "failed to build Kubernetes")
+	}
+
+	if buildSettings.HyperkubeImage == "" {
+		return nil
+	}
+	binaryDir, err := KubernetesSourceBinaryDir(sourceDir)
+	if err != nil {
+		return err
+	}
+	return buildHyperkubeImage(ctx, sourceDir, path.Join(binaryDir, "hyperkube"), buildSettings.HyperkubeImage, multiPrinter.NewWriter("image "))
+}
+
+// buildHyperkubeImage builds the hyperkube image with the Makefile in
+// `cluster/images/hyperkube` and pushes it as image, e.g.
+// `10.22.0.1:5000/me/hyperkube-amd64:my-test`, for the configured
+// architecture
+func buildHyperkubeImage(ctx context.Context, sourceDir, hyperkubeBin, image string, outWriter io.Writer) error {
+	// The Makefile builds `$(REGISTRY)/hyperkube-$(ARCH):$(VERSION)`
+	repository, tag := image, "latest"
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repository, tag = image[:i], image[i+1:]
+	}
+	i := strings.LastIndex(repository, "/")
+	if i < 0 {
+		return errors.Errorf("hyperkube image %q must include a registry to push to, e.g. 10.22.0.1:5000/me/hyperkube-amd64:my-test", image)
+	}
+	registry := repository[:i]
+	builtImage := fmt.Sprintf("%s/hyperkube-%s:%s", registry, bootstrap.Arch(), tag)
+
+	log.Printf("Building hyperkube image %s ...", image)
+	if err := runBuildCommand(ctx, sourceDir, outWriter, "make", "-C", "cluster/images/hyperkube",
+		fmt.Sprintf("ARCH=%s", bootstrap.Arch()),
+		fmt.Sprintf("VERSION=%s", tag),
+		fmt.Sprintf("REGISTRY=%s", registry),
+		fmt.Sprintf("HYPERKUBE_BIN=%s", hyperkubeBin)); err != nil {
+		return errors.Wrap(err, "failed to build hyperkube image")
+	}
+	if builtImage != image {
+		if err := runBuildCommand(ctx, sourceDir, outWriter, "docker", "tag", builtImage, image); err != nil {
+			return errors.Wrapf(err, "failed to tag hyperkube image as %q", image)
+		}
+	}
+
+	log.Printf("Pushing hyperkube image %s ...", image)
+	if err := runBuildCommand(ctx, sourceDir, outWriter, "docker", "push", image); err != nil {
+		return errors.Wrapf(err, "failed to push hyperkube image %q (is the registry running?)", image)
+	}
+	return nil
+}
+
+func runBuildCommand(ctx context.Context, dir string, outWriter io.Writer, args ...string) error {
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = dir
+	cmd.Stdout = outWriter
+	cmd.Stderr = outWriter
+	if err := cmd.Run(); err != nil {
+		return errors.Wrapf(err, "%q failed", strings.Join(args, " "))
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"log"
+	"path"
+
+	"github.com/kinvolk/kube-spawn/pkg/cache"
+)
+
+// CacheArtifactsInUse returns a function which reports whether a cache
+// artifact is used by one of the clusters in clustersDir, i.e. holds the
+// Kubernetes binaries of a version one of them or one of their node
+// groups runs, or socat for its architecture. If the state of a cluster
+// cannot be read, all Kubernetes and socat artifacts count as used.
+func CacheArtifactsInUse(clustersDir string) (func(*cache.Artifact) bool, error) {
+	names, err := ListNames(clustersDir)
+	if err != nil {
+		return nil, err
+	}
+
+	type artifactKey struct {
+		name, arch, version string
+	}
+	used := make(map[artifactKey]bool)
+	unknown := false
+	for _, name := range names {
+		kluster, err := New(path.Join(clustersDir, name), name)
+		if err != nil {
+			continue
+		}
+		state, err := kluster.State()
+		if err != nil {
+			log.Printf("WARNING: cannot tell which cached files cluster %q uses, keeping all: %v", name, err)
+			unknown = true
+			continue
+		}
+		arch := state.ClusterSettings.Arch
+		if arch == "" {
+			arch = "amd64"
+		}
+		used[artifactKey{cache.ArtifactSocat, arch, ""}] = true
+		if version := state.ClusterSettings.KubernetesVersion; version != "" {
+			used[artifactKey{cache.ArtifactKubernetes, arch, version}] = true
+		}
+		for _, nodeGroup := range state.ClusterSettings.NodeGroups {
+			used[artifactKey{cache.ArtifactKubernetes, arch, nodeGroup.KubernetesVersion}] = true
+		}
+	}
+
+	return func(artifact *cache.Artifact) bool {
+		if unknown && (artifact.Name == cache.ArtifactKubernetes || artifact.Name == cache.ArtifactSocat) {
+			return true
+		}
+		return used[artifactKey{artifact.Name, artifact.Arch, artifact.Version}]
+	}, nil
+}
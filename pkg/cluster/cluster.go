@@ -13,6 +13,8 @@ import (
 	"os/exec"
 	"path"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,9 +24,11 @@ import (
 
 	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
 	"github.com/kinvolk/kube-spawn/pkg/cache"
+	"github.com/kinvolk/kube-spawn/pkg/lock"
 	"github.com/kinvolk/kube-spawn/pkg/machinectl"
 	"github.com/kinvolk/kube-spawn/pkg/multiprint"
 	"github.com/kinvolk/kube-spawn/pkg/nspawntool"
+	"github.com/kinvolk/kube-spawn/pkg/storage"
 	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
 )
 
@@ -44,6 +48,47 @@ type ClusterSettings struct {
 	RktStage1ImagePath    string
 	RktletBinaryPath      string
 	UseLegacyCgroupDriver bool
+	NodeGroups            []NodeGroup
+	// Arch is the architecture of the binaries in the cluster, see
+	// bootstrap.SetArch
+	Arch string
+	// ProxyEnv holds the HTTP_PROXY, HTTPS_PROXY and NO_PROXY settings
+	// for the nodes, see bootstrap.ProxyEnvironment. They may contain
+	// credentials and are only written to the nodes' rootfs, not to the
+	// cluster state file.
+	ProxyEnv map[string]string `json:"-"`
+}
+
+// StartSettings holds the options for starting the nodes of a cluster
+type StartSettings struct {
+	Nodes        int
+	CNIPluginDir string
+	CNIPlugin    string
+	// BaseImage is the name of a built-in base image or the path to an
+	// image file, see bootstrap.GetBaseImage
+	BaseImage      string
+	FlatcarChannel string
+	// ImageVerification configures the signature check of the base
+	// image when it is downloaded
+	ImageVerification bootstrap.ImageVerification
+	// WaitTimeout is how long to wait for all nodes to become Ready and
+	// all kube-system pods to run. Zero means don't wait.
+	WaitTimeout time.Duration
+	// KeepOnFailure disables the removal of the machines created by
+	// a failed start, so that they can be inspected
+	KeepOnFailure bool
+	// LockTimeout is how long to wait for the host lock held by other
+	// kube-spawn processes while preparing the host
+	LockTimeout time.Duration
+	// NodeGroupSizes is the number of workers to start per node group,
+	// in addition to Nodes
+	NodeGroupSizes map[string]int
+	// GrowPool allows growing the machine pool if it is too small for
+	// the cluster, otherwise the start fails
+	GrowPool bool
+	// StorageDriver is how the machine images are created from the base
+	// image, one of storage.Drivers()
+	StorageDriver string
 }
 
 type Cluster struct {
@@ -95,6 +140,9 @@ var cniFiles = map[string][]string{
 
 var validNameRegexp = regexp.MustCompile(validNameRegexpStr)
 
+// lockFileName is the name of the cluster lock file in the cluster dir
+const lockFileName = ".lock"
+
 func ValidName(name string) bool {
 	return validNameRegexp.MatchString(name)
 }
@@ -116,7 +164,7 @@ func validateClusterSettings(clusterSettings *ClusterSettings) error {
 	if clusterSettings.ContainerRuntime != "docker" && clusterSettings.ContainerRuntime != "rkt" {
 		return errors.Errorf("unsupported container runtime given: %s", clusterSettings.ContainerRuntime)
 	}
-	return nil
+	return validateNodeGroups(clusterSettings.NodeGroups)
 }
 
 // Create creates a new kube-spawn cluster environment. It does..
@@ -127,7 +175,77 @@ func validateClusterSettings(clusterSettings *ClusterSettings) error {
 //   mounted via overlayfs)
 // * Copy the required files from the source directories and cache to
 //   the target locations
-func (c *Cluster) Create(clusterSettings *ClusterSettings, clusterCache *cache.Cache) error {
+//
+// If creating the cluster fails or the context is cancelled, everything
+// created in the cluster directory is removed again. The lock file held
+// by the caller is left alone, as removing it would let another process
+// lock a new file at the same path meanwhile.
+func (c *Cluster) Create(ctx context.Context, clusterSettings *ClusterSettings, clusterCache *cache.Cache) error {
+	// The cluster directory itself might exist already as it holds
+	// the cluster lock
+	if exists, err := fs.PathExists(c.BaseRootfsPath()); err != nil {
+		return errors.Wrapf(err, "failed to stat %q", c.BaseRootfsPath())
+	} else if exists {
+		return errors.Errorf("cluster %q exists already", c.name)
+	}
+	if err := c.create(ctx, clusterSettings, clusterCache); err != nil {
+		if removeErr := c.removeContents(); removeErr != nil {
+			log.Printf("Failed to clean up cluster dir %q: %v", c.dir, removeErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// removeContents removes everything in the cluster dir but the lock file
+func (c *Cluster) removeContents() error {
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Name() == lockFileName {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(c.dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListNames returns the names of the clusters in clustersDir. Directories
+// holding nothing but the lock file, e.g. left behind by a failed create,
+// are skipped.
+func ListNames(clustersDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(clustersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		clusterEntries, err := ioutil.ReadDir(path.Join(clustersDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(clusterEntries) == 0 || (len(clusterEntries) == 1 && clusterEntries[0].Name() == lockFileName) {
+			continue
+		}
+		names = append(names, entry.Name())
+	}
+	return names, nil
+}
+
+func (c *Cluster) create(ctx context.Context, clusterSettings *ClusterSettings, clusterCache *cache.Cache) error {
 	if err := validateClusterSettings(clusterSettings); err != nil {
 		return err
 	}
@@ -135,15 +253,15 @@ func (c *Cluster) Create(clusterSettings *ClusterSettings, clusterCache *cache.C
 		return errors.Errorf("no cache given but required")
 	}
 
-	cacheDirKubernetes := path.Join(clusterCache.Dir(), "kubernetes")
+	clusterSettings.Arch = bootstrap.Arch()
 
 	if clusterSettings.KubernetesSourceDir == "" {
-		if err := bootstrap.DownloadKubernetesBinaries(clusterSettings.KubernetesVersion, cacheDirKubernetes); err != nil {
+		if err := bootstrap.DownloadKubernetesBinaries(ctx, clusterSettings.KubernetesVersion, clusterCache); err != nil {
 			return errors.Wrap(err, "failed to download required Kubernetes binaries")
 		}
 	}
 
-	if err := bootstrap.DownloadSocatBin(clusterCache.Dir()); err != nil {
+	if err := bootstrap.DownloadSocatBin(ctx, clusterCache); err != nil {
 		return errors.Wrap(err, "failed to download `socat` into cache dir")
 	}
 
@@ -159,29 +277,17 @@ func (c *Cluster) Create(clusterSettings *ClusterSettings, clusterCache *cache.C
 		kubectlPath        string
 		kubeletServicePath string
 		kubeadmDropinPath  string
+		// whether the Kubernetes files come from the cache and can be
+		// linked instead of copied
+		kubernetesFromCache bool
 	)
 	if clusterSettings.KubernetesSourceDir != "" {
-		// If Docker was used to build Kubernetes (`build/run.sh make`),
-		// the binaries would be in `"_output/dockerized/bin/linux/amd64`,
-		// look their first. If we don't find them there, try with
-		// `_output/bin`
-		kubernetesSourceBinaryDir := path.Join(clusterSettings.KubernetesSourceDir, "_output/dockerized/bin/linux/amd64")
-
-		kubeadmPath = path.Join(kubernetesSourceBinaryDir, "kubeadm")
-		if exists, err := fs.PathExists(kubeadmPath); err != nil {
-			return errors.Wrapf(err, "Failed to stat %q: %v", kubeadmPath)
-		} else if !exists {
-			kubernetesSourceBinaryDir = path.Join(clusterSettings.KubernetesSourceDir, "_output/bin")
-
-			kubeadmPath = path.Join(kubernetesSourceBinaryDir, "kubeadm")
-			if exists, err := fs.PathExists(kubeadmPath); err != nil {
-				return errors.Wrapf(err, "Failed to stat %q: %v", kubernetesSourceBinaryDir)
-			} else if !exists {
-				return errors.Errorf("Cannot find expected `_output` directory in %q", clusterSettings.KubernetesSourceDir)
-			}
-
+		kubernetesSourceBinaryDir, err := KubernetesSourceBinaryDir(clusterSettings.KubernetesSourceDir)
+		if err != nil {
+			return err
 		}
 
+		kubeadmPath = path.Join(kubernetesSourceBinaryDir, "kubeadm")
 		kubeletPath = path.Join(kubernetesSourceBinaryDir, "kubelet")
 		kubectlPath = path.Join(kubernetesSourceBinaryDir, "kubectl")
 
@@ -190,31 +296,35 @@ func (c *Cluster) Create(clusterSettings *ClusterSettings, clusterCache *cache.C
 		kubeletServicePath = path.Join(kubernetesSourceBuildDir, "debs/kubelet.service")
 		kubeadmDropinPath = path.Join(kubernetesSourceBuildDir, "rpms/10-kubeadm.conf")
 	} else {
-		kubeletPath = path.Join(cacheDirKubernetes, clusterSettings.KubernetesVersion, "kubelet")
-		kubeadmPath = path.Join(cacheDirKubernetes, clusterSettings.KubernetesVersion, "kubeadm")
-		kubectlPath = path.Join(cacheDirKubernetes, clusterSettings.KubernetesVersion, "kubectl")
+		kubernetesFromCache = true
+		cacheDirKubernetes := bootstrap.KubernetesCacheDir(clusterCache, clusterSettings.KubernetesVersion)
+		kubeletPath = path.Join(cacheDirKubernetes, "kubelet")
+		kubeadmPath = path.Join(cacheDirKubernetes, "kubeadm")
+		kubectlPath = path.Join(cacheDirKubernetes, "kubectl")
 
-		kubeletServicePath = path.Join(cacheDirKubernetes, clusterSettings.KubernetesVersion, "kubelet.service")
-		kubeadmDropinPath = path.Join(cacheDirKubernetes, clusterSettings.KubernetesVersion, "10-kubeadm.conf")
+		kubeletServicePath = path.Join(cacheDirKubernetes, "kubelet.service")
+		kubeadmDropinPath = path.Join(cacheDirKubernetes, "10-kubeadm.conf")
 	}
 
 	type copyItem struct {
 		dst string
 		src string
+		// link is true for files from the cache, see fs.LinkOrCopy
+		link bool
 	}
 	var copyItems []copyItem
 
 	// copyItem destinations must be relative to the cluster rootfs path
 	// We will prepend it later
 
-	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubelet", src: kubeletPath})
-	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubeadm", src: kubeadmPath})
-	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubectl", src: kubectlPath})
-	copyItems = append(copyItems, copyItem{dst: "/etc/systemd/system/kubelet.service", src: kubeletServicePath})
-	copyItems = append(copyItems, copyItem{dst: "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf", src: kubeadmDropinPath})
+	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubelet", src: kubeletPath, link: kubernetesFromCache})
+	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubeadm", src: kubeadmPath, link: kubernetesFromCache})
+	copyItems = append(copyItems, copyItem{dst: "/usr/bin/kubectl", src: kubectlPath, link: kubernetesFromCache})
+	copyItems = append(copyItems, copyItem{dst: "/etc/systemd/system/kubelet.service", src: kubeletServicePath, link: kubernetesFromCache})
+	copyItems = append(copyItems, copyItem{dst: "/etc/systemd/system/kubelet.service.d/10-kubeadm.conf", src: kubeadmDropinPath, link: kubernetesFromCache})
 
-	socatPath := path.Join(clusterCache.Dir(), "socat")
-	copyItems = append(copyItems, copyItem{dst: "/usr/bin/socat", src: socatPath})
+	socatPath := bootstrap.SocatCachePath(clusterCache)
+	copyItems = append(copyItems, copyItem{dst: "/usr/bin/socat", src: socatPath, link: true})
 	for _, file := range cniFiles["base"] {
 		var dst string = path.Join("opt/cni/bin", file)
 		var src string = path.Join(clusterSettings.CNIPluginDir, file)
@@ -232,43 +342,94 @@ func (c *Cluster) Create(clusterSettings *ClusterSettings, clusterCache *cache.C
 		copyItems = append(copyItems, copyItem{dst: "/usr/bin/rktlet", src: clusterSettings.RktletBinaryPath})
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-
-	var failed bool
-	errorChan := make(chan error)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case err, ok := <-errorChan:
-				if !ok {
-					return
-				}
-				failed = true
-				log.Printf("%v", err)
-			}
-		}
-	}()
-
-	var wg sync.WaitGroup
-	wg.Add(len(copyItems))
+	group, groupCtx := newTaskGroup(ctx)
 	for _, item := range copyItems {
-		go func(dst, src string) {
-			defer wg.Done()
-			dst = path.Join(c.BaseRootfsPath(), dst)
-			if copyErr := fs.CopyFile(src, dst); copyErr != nil {
-				errorChan <- errors.Wrapf(copyErr, "Failed to copy file %q -> %q", src, dst)
+		dst := path.Join(c.BaseRootfsPath(), item.dst)
+		src := item.src
+		copyFunc := fs.CopyFile
+		if item.link {
+			copyFunc = fs.LinkOrCopy
+		}
+		group.Go(func() error {
+			if err := groupCtx.Err(); err != nil {
+				return err
 			}
-		}(item.dst, item.src)
+			if err := copyFunc(src, dst); err != nil {
+				return errors.Wrapf(err, "Failed to copy file %q -> %q", src, dst)
+			}
+			return nil
+		})
 	}
-	wg.Wait()
+	if err := group.Wait(); err != nil {
+		return errors.Wrap(err, "copying necessary files didn't succeed")
+	}
+	if err := prepareBaseRootfs(c.BaseRootfsPath(), clusterSettings); err != nil {
+		return err
+	}
+	if err := c.createNodeGroups(ctx, clusterSettings, clusterCache); err != nil {
+		return err
+	}
+	return c.saveState(&State{ClusterSettings: clusterSettings})
+}
+
+// checkArch fails if the cluster was created for a different
+// architecture than the configured one
+func checkArch(clusterSettings *ClusterSettings) error {
+	clusterArch := clusterSettings.Arch
+	if clusterArch == "" {
+		// created before kube-spawn supported other architectures
+		clusterArch = "amd64"
+	}
+	if clusterArch != bootstrap.Arch() {
+		return errors.Errorf("cluster was created for %s, not %s (use --arch %s)", clusterArch, bootstrap.Arch(), clusterArch)
+	}
+	return nil
+}
+
+// checkHostArch fails if the cluster was created for an architecture the
+// host cannot run
+func (c *Cluster) checkHostArch() error {
+	state, err := c.State()
+	if err != nil {
+		// no state to check against
+		return nil
+	}
+	hostArch, err := bootstrap.HostArch()
+	if err != nil {
+		return err
+	}
+	if clusterArch := state.ClusterSettings.Arch; clusterArch != "" && clusterArch != hostArch {
+		return errors.Errorf("cluster %q was created for %s and cannot run on this %s host", c.name, clusterArch, hostArch)
+	}
+	return nil
+}
 
-	if failed {
-		return errors.Errorf("copying necessary files didn't succeed")
+// KubernetesSourceBinaryDir returns the directory with the binaries
+// built from the given Kubernetes source directory
+func KubernetesSourceBinaryDir(kubernetesSourceDir string) (string, error) {
+	// If Docker was used to build Kubernetes (`build/run.sh make`),
+	// the binaries would be in `"_output/dockerized/bin/linux/<arch>`,
+	// look their first. If we don't find them there, try with
+	// `_output/local/bin/linux/<arch>` and, when not cross-compiling,
+	// `_output/bin`
+	arch := bootstrap.Arch()
+	dirs := []string{
+		path.Join("_output/dockerized/bin/linux", arch),
+		path.Join("_output/local/bin/linux", arch),
+	}
+	if hostArch, err := bootstrap.HostArch(); err == nil && hostArch == arch {
+		dirs = append(dirs, "_output/bin")
+	}
+	for _, dir := range dirs {
+		binaryDir := path.Join(kubernetesSourceDir, dir)
+		kubeadmPath := path.Join(binaryDir, "kubeadm")
+		if exists, err := fs.PathExists(kubeadmPath); err != nil {
+			return "", errors.Wrapf(err, "Failed to stat %q", kubeadmPath)
+		} else if exists {
+			return binaryDir, nil
+		}
 	}
-	return prepareBaseRootfs(c.BaseRootfsPath(), clusterSettings)
+	return "", errors.Errorf("Cannot find expected `_output` directory in %q", kubernetesSourceDir)
 }
 
 func prepareBaseRootfs(rootfsDir string, clusterSettings *ClusterSettings) error {
@@ -291,6 +452,9 @@ func prepareBaseRootfs(rootfsDir string, clusterSettings *ClusterSettings) error
 	if err := fs.CreateFileFromString(path.Join(rootfsDir, "/etc/resolv.conf"), "nameserver 8.8.8.8"); err != nil {
 		return err
 	}
+	if err := writeProxyDropins(rootfsDir, clusterSettings); err != nil {
+		return err
+	}
 
 	if clusterSettings.ContainerRuntime == "rkt" {
 		buf, err := ExecuteTemplate(RktletSystemdUnitTmpl, clusterSettings)
@@ -356,102 +520,105 @@ func prepareBaseRootfs(rootfsDir string, clusterSettings *ClusterSettings) error
 	return nil
 }
 
-func (c *Cluster) Start(numberNodes int, cniPluginDir, cniPlugin, flatcarChannel string) error {
-	if numberNodes < 1 {
-		return errors.Errorf("cannot start less than 1 node")
+// Start starts the nodes of the cluster and provisions them with kubeadm.
+// If anything fails, all machines, images and network leases created
+// by this invocation are removed again, unless KeepOnFailure is set.
+//
+// Cancelling the context stops all in-flight operations; the machines
+// started so far are then removed like on any other failure.
+func (c *Cluster) Start(ctx context.Context, startSettings *StartSettings) error {
+	created := &machineSet{}
+	err := c.start(ctx, startSettings, created)
+	if err == nil {
+		return nil
 	}
-	if err := bootstrap.PrepareBaseImage(flatcarChannel); err != nil {
+	createdNames := created.names()
+	if len(createdNames) == 0 {
 		return err
 	}
-
-	if err := bootstrap.EnsureRequirements(); err != nil {
+	if startSettings.KeepOnFailure {
+		log.Printf("Keeping machines of failed start for debugging: %s", strings.Join(createdNames, " "))
 		return err
 	}
+	log.Printf("Start failed, removing %d machines created by this invocation ...", len(createdNames))
+	if rollbackErr := c.rollback(created); rollbackErr != nil {
+		log.Printf("Rollback failed: %v", rollbackErr)
+	}
+	return err
+}
+
+func (c *Cluster) start(ctx context.Context, startSettings *StartSettings, created *machineSet) error {
+	if startSettings.Nodes < 1 {
+		return errors.Errorf("cannot start less than 1 node")
+	}
 
-	poolExists, err := bootstrap.CheckPoolExists()
+	// Note: currently only a single master node is supported and
+	// the code written with that limitation. Supporting multiple
+	// master nodes shouldn't be too much work though (figure out
+	// multi master setup with kubeadm + use loadbalancer + use
+	// loadbalancer IP from worker nodes)
+	machineNames := []string{c.machineName("master")}
+	for i := 1; i < startSettings.Nodes; i++ {
+		machineNames = append(machineNames, c.machineName("worker"))
+	}
+	nodeGroupMachineNames, err := c.nodeGroupMachineNames(startSettings.NodeGroupSizes)
 	if err != nil {
 		return err
 	}
+	machineNames = append(machineNames, nodeGroupMachineNames...)
+	numberNodes := len(machineNames)
 
-	// TODO This shouldn't be hardcoded, but I don't know where to put it yet
-	imageName := "flatcar"
-	if poolExists {
-		imageName = bootstrap.BaseImageName
+	if err := c.checkHostArch(); err != nil {
+		return err
 	}
 
-	poolSize, err := bootstrap.GetPoolSize(imageName, numberNodes)
+	baseImage, err := bootstrap.GetBaseImage(startSettings.BaseImage)
+	if err != nil {
+		return err
+	}
+	storageDriver, err := c.prepareHost(ctx, baseImage, startSettings, numberNodes)
 	if err != nil {
 		return err
 	}
 
-	if poolExists {
-		log.Printf("new poolSize to be : %d\n", poolSize)
-		if err := bootstrap.EnlargeStoragePool(poolSize); err != nil {
-			return err
-		}
+	if err := ctx.Err(); err != nil {
+		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	var failed bool
-	errorChan := make(chan error)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case err, ok := <-errorChan:
-				if !ok {
-					return
-				}
-				failed = true
-				log.Printf("%v", err)
-			}
-		}
-	}()
-
 	log.Printf("Starting %d nodes in cluster %s ...", numberNodes, c.name)
 
-	// Note: currently only a single master node is supported and
-	// the code written with that limitation. Supporting multiple
-	// master nodes shouldn't be too much work though (figure out
-	// multi master setup with kubeadm + use loadbalancer + use
-	// loadbalancer IP from worker nodes)
-
-	var wg sync.WaitGroup
-	wg.Add(numberNodes)
-	for i := 0; i < numberNodes; i++ {
-		go func(nodeNumber int) {
-			defer wg.Done()
-
-			var machineNameSuffix string
-			if nodeNumber == 0 {
-				machineNameSuffix = fmt.Sprintf("master-%s", randString(6))
-			} else {
-				machineNameSuffix = fmt.Sprintf("worker-%s", randString(6))
-			}
-			machineName := fmt.Sprintf("kube-spawn-%s-%s", c.name, machineNameSuffix)
-
+	group, groupCtx := newTaskGroup(ctx)
+	for _, machineName := range machineNames {
+		machineName := machineName
+		group.Go(func() error {
 			log.Printf("Waiting for machine %s to start up ...", machineName)
 
-			if err := nspawntool.Run(bootstrap.BaseImageName, c.BaseRootfsPath(), path.Join(c.MachineRootfsPath(), machineName), machineName, cniPluginDir); err != nil {
-				errorChan <- errors.Wrapf(err, "Failed to start machine %s", machineName)
-				return
+			created.add(machineName)
+
+			if err := nspawntool.Run(groupCtx, storageDriver, baseImage.Name, c.machineLowerRootfsPath(machineName), path.Join(c.MachineRootfsPath(), machineName), machineName, startSettings.CNIPluginDir); err != nil {
+				return errors.Wrapf(err, "Failed to start machine %s", machineName)
 			}
 
 			log.Printf("Started %s", machineName)
 			log.Printf("Bootstrapping %s ...", machineName)
 
-			if err := machinectl.Exec(machineName, "/opt/kube-spawn/bootstrap.sh"); err != nil {
-				errorChan <- errors.Wrapf(err, "Failed to bootstrap machine %s", machineName)
+			bootstrapLog, err := c.createMachineLog(machineName, "bootstrap.log")
+			if err != nil {
+				return err
 			}
-		}(i)
-	}
-	wg.Wait()
+			defer bootstrapLog.Close()
 
-	if failed {
-		return errors.Errorf("starting the cluster didn't succeed")
+			if _, err := machinectl.RunCommandContext(groupCtx, bootstrapLog, bootstrapLog, "", "shell", machineName, "/opt/kube-spawn/bootstrap.sh"); err != nil {
+				return errors.Wrapf(err, "Failed to bootstrap machine %s (see %s)", machineName, bootstrapLog.Name())
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return errors.Wrap(err, "starting the cluster didn't succeed")
 	}
 
 	log.Printf("Cluster %q started", c.name)
@@ -478,13 +645,19 @@ func (c *Cluster) Start(numberNodes int, cniPluginDir, cniPlugin, flatcarChannel
 		return errors.Wrap(err, "failed to determine kubeadm version")
 	}
 
-	shortName := strings.TrimPrefix(masterMachine.Name, fmt.Sprintf("kube-spawn-%s-", c.name))
+	shortName := c.ShortMachineName(masterMachine.Name)
 	cliWriter := multiPrinter.NewWriter(fmt.Sprintf("%s ", shortName))
-	if err := kubeadmInit(kubeadmVersion, masterMachine.Name, cliWriter); err != nil {
-		return errors.Wrapf(err, "failed to kubeadm init %q", masterMachine.Name)
+	kubeadmInitLog, err := c.createMachineLog(masterMachine.Name, "kubeadm-init.log")
+	if err != nil {
+		return err
+	}
+	defer kubeadmInitLog.Close()
+	if err := kubeadmInit(ctx, kubeadmVersion, masterMachine.Name, io.MultiWriter(kubeadmInitLog, cliWriter)); err != nil {
+		return errors.Wrapf(err, "failed to kubeadm init %q (see %s)", masterMachine.Name, kubeadmInitLog.Name())
 	}
 
 	adminKubeconfigSource := path.Join(c.MachineRootfsPath(), masterMachine.Name, "etc/kubernetes/admin.conf")
+	created.adminKubeconfig = true
 	if err := fs.CopyFile(adminKubeconfigSource, c.AdminKubeconfigPath()); err != nil {
 		return err
 	}
@@ -496,31 +669,93 @@ func (c *Cluster) Start(numberNodes int, cniPluginDir, cniPlugin, flatcarChannel
 
 	masterIP := masterMachine.IP
 
-	wg.Add(len(workerMachines))
+	group, groupCtx = newTaskGroup(ctx)
 	for _, worker := range workerMachines {
-		go func(nodeName string) {
-			defer wg.Done()
-			shortName := strings.TrimPrefix(nodeName, fmt.Sprintf("kube-spawn-%s-", c.name))
-			if err := kubeadmJoin(kubeadmVersion, masterIP, nodeName, multiPrinter.NewWriter(fmt.Sprintf("%s ", shortName))); err != nil {
-				errorChan <- errors.Wrapf(err, "Failed to kubeadm join %q", worker.Name)
+		nodeName := worker.Name
+		group.Go(func() error {
+			// Workers of node groups join with the kubeadm version
+			// of their group
+			joinKubeadmVersion, err := kubeadmGitVersion(path.Join(c.machineLowerRootfsPath(nodeName), "usr/bin/kubeadm"))
+			if err != nil {
+				return errors.Wrapf(err, "failed to determine kubeadm version of %q", nodeName)
+			}
+			shortName := c.ShortMachineName(nodeName)
+			kubeadmJoinLog, err := c.createMachineLog(nodeName, "kubeadm-join.log")
+			if err != nil {
+				return err
+			}
+			defer kubeadmJoinLog.Close()
+			outWriter := io.MultiWriter(kubeadmJoinLog, multiPrinter.NewWriter(fmt.Sprintf("%s ", shortName)))
+			if err := kubeadmJoin(groupCtx, joinKubeadmVersion, masterIP, nodeName, outWriter); err != nil {
+				return errors.Wrapf(err, "Failed to kubeadm join %q (see %s)", nodeName, kubeadmJoinLog.Name())
 			}
-		}(worker.Name)
+			return nil
+		})
 	}
-	wg.Wait()
-
-	if failed {
-		return errors.Errorf("provisioning the worker nodes with kubeadm didn't succeed")
+	if err := group.Wait(); err != nil {
+		return errors.Wrap(err, "provisioning the worker nodes with kubeadm didn't succeed")
 	}
 
 	kubectlPath := path.Join(c.BaseRootfsPath(), "usr/bin/kubectl")
 	cniConfigDirPath := path.Join(c.BaseRootfsPath(), "etc/cni")
-	if err := applyNetworkPlugin(kubectlPath, c.AdminKubeconfigPath(), cniConfigDirPath, cniPlugin, cliWriter); err != nil {
-		return errors.Wrapf(err, "Failed to apply network plugin %q", cniPlugin)
+	if err := applyNetworkPlugin(ctx, kubectlPath, c.AdminKubeconfigPath(), cniConfigDirPath, startSettings.CNIPlugin, cliWriter); err != nil {
+		return errors.Wrapf(err, "Failed to apply network plugin %q", startSettings.CNIPlugin)
+	}
+
+	if startSettings.WaitTimeout > 0 {
+		log.Printf("Waiting up to %s for cluster %q to become ready ...", startSettings.WaitTimeout, c.name)
+		readyWriter := multiPrinter.NewWriter("ready ")
+		if err := waitClusterReady(ctx, kubectlPath, c.AdminKubeconfigPath(), numberNodes, startSettings.WaitTimeout, readyWriter); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// prepareHost runs the steps which modify host-level state shared by all
+// clusters while holding the host lock. It returns the storage driver
+// to create the machines with.
+func (c *Cluster) prepareHost(ctx context.Context, baseImage *bootstrap.BaseImage, startSettings *StartSettings, numberNodes int) (string, error) {
+	hostLock, err := lock.AcquireHost(startSettings.LockTimeout)
+	if err != nil {
+		return "", err
+	}
+	defer hostLock.Release()
+
+	if err := bootstrap.PrepareBaseImage(ctx, baseImage, startSettings.FlatcarChannel, &startSettings.ImageVerification, startSettings.GrowPool); err != nil {
+		return "", err
+	}
+
+	if err := bootstrap.EnsureRequirements(baseImage); err != nil {
+		return "", err
+	}
+
+	// /var/lib/machines might only exist after pulling the base image,
+	// so the driver is resolved afterwards
+	storageDriver, err := storage.ResolveDriver(startSettings.StorageDriver)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Using %s storage driver", storageDriver)
+
+	if storageDriver == storage.DriverBtrfs {
+		poolSize, err := bootstrap.GetPoolSize(baseImage.Name, numberNodes)
+		if err != nil {
+			return "", err
+		}
+		if err := bootstrap.EnsurePoolSize(poolSize, startSettings.GrowPool); err != nil {
+			return "", err
+		}
+	}
+
+	if err := storage.Prepare(ctx, storageDriver, baseImage.Name); err != nil {
+		return "", err
+	}
+
+	return storageDriver, nil
+}
+
 func (c *Cluster) AdminKubeconfigPath() string {
 	return path.Join(c.dir, "admin.kubeconfig")
 }
@@ -533,6 +768,9 @@ func (c *Cluster) AdminKubeconfig() (string, error) {
 	return string(kubeconfigBytes), nil
 }
 
+// BaseRootfsPath returns the path of the shared, readonly rootfs the
+// nodes' overlay mounts are based on. After an upgrade, it is a symlink
+// to the base rootfs layer of the current version.
 func (c *Cluster) BaseRootfsPath() string {
 	return path.Join(c.dir, "rootfs-base-readonly")
 }
@@ -541,22 +779,127 @@ func (c *Cluster) MachineRootfsPath() string {
 	return path.Join(c.dir, "rootfs-machines")
 }
 
+func (c *Cluster) masterMachinePattern() string {
+	return fmt.Sprintf("^kube-spawn-%s-master-[a-z0-9]+$", c.name)
+}
+
+func (c *Cluster) workerMachinePattern() string {
+	return fmt.Sprintf("^kube-spawn-%s-worker-([a-z0-9]+-)?[a-z0-9]+$", c.name)
+}
+
 func (c *Cluster) MasterMachines() ([]machinectl.Machine, error) {
-	return machinectl.ListByRegexp(fmt.Sprintf("^kube-spawn-%s-master-[a-z0-9]+$", c.name))
+	return machinectl.ListByRegexp(c.masterMachinePattern())
 }
 
 func (c *Cluster) WorkerMachines() ([]machinectl.Machine, error) {
-	return machinectl.ListByRegexp(fmt.Sprintf("^kube-spawn-%s-worker-[a-z0-9]+$", c.name))
+	return machinectl.ListByRegexp(c.workerMachinePattern())
 }
 
 func (c *Cluster) Machines() ([]machinectl.Machine, error) {
 	return machinectl.ListByRegexp(fmt.Sprintf("^kube-spawn-%s.*$", c.name))
 }
 
+// ShortMachineName returns the machine name without the
+// `kube-spawn-<cluster>-` prefix, e.g. `worker-fpllng`
+func (c *Cluster) ShortMachineName(machineName string) string {
+	return strings.TrimPrefix(machineName, fmt.Sprintf("kube-spawn-%s-", c.name))
+}
+
+// ResolveMachine finds the running machine of the cluster referred to by
+// name, which can be one of
+//
+// * the full machine name, e.g. `kube-spawn-default-worker-fpllng`
+// * the short machine name, e.g. `worker-fpllng`
+// * `master` for the (first) master node
+// * `worker-N` for the N-th worker node, counting from 1
+func (c *Cluster) ResolveMachine(name string) (machinectl.Machine, error) {
+	machines, err := c.Machines()
+	if err != nil {
+		return machinectl.Machine{}, errors.Wrap(err, "failed to list machines")
+	}
+	var machineNames []string
+	for _, machine := range machines {
+		machineNames = append(machineNames, machine.Name)
+	}
+	if machineName := c.matchMachineName(machineNames, name); machineName != "" {
+		for _, machine := range machines {
+			if machine.Name == machineName {
+				return machine, nil
+			}
+		}
+	}
+	return machinectl.Machine{}, errors.Errorf("no machine %q running in cluster %q", name, c.name)
+}
+
+// ResolveLoggedMachine finds the machine logs were captured for referred
+// to by name like ResolveMachine, also if it isn't running anymore
+func (c *Cluster) ResolveLoggedMachine(name string) (string, error) {
+	machineNames, err := c.LoggedMachines()
+	if err != nil {
+		return "", errors.Wrap(err, "failed to list captured logs")
+	}
+	if machineName := c.matchMachineName(machineNames, name); machineName != "" {
+		return machineName, nil
+	}
+	return "", errors.Errorf("no logs captured for node %q", name)
+}
+
+// matchMachineName returns the machine of machineNames referred to by
+// name as described for ResolveMachine, or "" if there is none. The
+// master and worker-N names refer to the machines sorted by name.
+func (c *Cluster) matchMachineName(machineNames []string, name string) string {
+	sorted := append([]string{}, machineNames...)
+	sort.Strings(sorted)
+	for _, machineName := range sorted {
+		if machineName == name || c.ShortMachineName(machineName) == name {
+			return machineName
+		}
+	}
+
+	if name == "master" {
+		masterRegexp := regexp.MustCompile(c.masterMachinePattern())
+		for _, machineName := range sorted {
+			if masterRegexp.MatchString(machineName) {
+				return machineName
+			}
+		}
+		return ""
+	}
+
+	if strings.HasPrefix(name, "worker-") {
+		if n, err := strconv.Atoi(strings.TrimPrefix(name, "worker-")); err == nil {
+			workerRegexp := regexp.MustCompile(c.workerMachinePattern())
+			var workers []string
+			for _, machineName := range sorted {
+				if workerRegexp.MatchString(machineName) {
+					workers = append(workers, machineName)
+				}
+			}
+			if n >= 1 && n <= len(workers) {
+				return workers[n-1]
+			}
+		}
+	}
+	return ""
+}
+
 func (c *Cluster) ListImages() ([]machinectl.Image, error) {
 	return machinectl.ListImagesByRegexp(fmt.Sprintf("^kube-spawn-%s.*$", c.name))
 }
 
+// Lock takes the advisory lock of the cluster, which should be held by
+// any command operating on the cluster
+func (c *Cluster) Lock(timeout time.Duration) (*lock.Lock, error) {
+	l, err := lock.Acquire(path.Join(c.dir, lockFileName), fmt.Sprintf("cluster %q", c.name), timeout)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("cluster %q doesn't exist", c.name)
+		}
+		return nil, err
+	}
+	return l, nil
+}
+
 func (c *Cluster) Stop() error {
 	if err := c.StopMachines(30 * time.Second); err != nil {
 		return err
@@ -564,6 +907,9 @@ func (c *Cluster) Stop() error {
 	if err := c.RemoveImages(30 * time.Second); err != nil {
 		return err
 	}
+	if err := c.removeStaleBaseRootfsLayers(); err != nil {
+		return err
+	}
 	// TODO(schu): remove network bits
 	return nil
 }
@@ -572,6 +918,7 @@ func (c *Cluster) Destroy() error {
 	if err := c.Stop(); err != nil {
 		return err
 	}
+	c.removeMergedKubeconfigs()
 	if err := os.RemoveAll(c.dir); err != nil {
 		return errors.Errorf("failed to remove cluster dir %q: %v", c.dir, err)
 	}
@@ -583,8 +930,23 @@ func (c *Cluster) RemoveImages(timeout time.Duration) error {
 	if err != nil {
 		return err
 	}
+	removeImages(images, timeout)
+
+	images, err = c.ListImages()
+	if err != nil {
+		return err
+	}
+	if len(images) > 0 {
+		return errors.Errorf("failed to remove all images (use `machinectl remove ...` to remove them manually)")
+	}
+	return nil
+}
+
+// removeImages tries to remove the given images until either all of them
+// are gone or the timeout is reached
+func removeImages(images []machinectl.Image, timeout time.Duration) {
 	if len(images) == 0 {
-		return nil
+		return
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), timeout)
@@ -598,7 +960,7 @@ func (c *Cluster) RemoveImages(timeout time.Duration) error {
 		go func(imageName string, idx int) {
 			defer wg.Done()
 			for range tickChan {
-				if err := machinectl.Remove(imageName); err == nil {
+				if err := storage.RemoveMachine(imageName); err == nil {
 					return
 				}
 				select {
@@ -611,15 +973,6 @@ func (c *Cluster) RemoveImages(timeout time.Duration) error {
 		}(image.Name, i)
 	}
 	wg.Wait()
-
-	images, err = c.ListImages()
-	if err != nil {
-		return err
-	}
-	if len(images) > 0 {
-		return errors.Errorf("failed to remove all images (use `machinectl remove ...` to remove them manually)")
-	}
-	return nil
 }
 
 func (c *Cluster) StopMachines(timeout time.Duration) error {
@@ -627,6 +980,12 @@ func (c *Cluster) StopMachines(timeout time.Duration) error {
 	if err != nil {
 		return err
 	}
+	return stopMachines(machines, timeout)
+}
+
+// stopMachines powers off the given machines and terminates the ones
+// which are still running after the timeout
+func stopMachines(machines []machinectl.Machine, timeout time.Duration) error {
 	if len(machines) == 0 {
 		return nil
 	}
@@ -670,7 +1029,7 @@ waitPoweroff:
 	return nil
 }
 
-func kubeadmInit(kubeadmVersionStr, machineName string, outWriter io.Writer) error {
+func kubeadmInit(ctx context.Context, kubeadmVersionStr, machineName string, outWriter io.Writer) error {
 	initCmd := []string{
 		"/usr/bin/kubeadm",
 		"init",
@@ -689,16 +1048,16 @@ func kubeadmInit(kubeadmVersionStr, machineName string, outWriter io.Writer) err
 	} else {
 		initCmd = append(initCmd, "--ignore-preflight-errors=all")
 	}
-	if _, err := machinectl.RunCommand(outWriter, nil, "", "shell", machineName, initCmd...); err != nil {
+	if _, err := machinectl.RunCommandContext(ctx, outWriter, nil, "", "shell", machineName, initCmd...); err != nil {
 		return errors.Wrap(err, "kubeadm init failed")
 	}
-	if _, err := machinectl.RunCommand(outWriter, nil, "", "shell", machineName, "/usr/bin/kubeadm", "token", "create", kubeadmToken, "--ttl=0"); err != nil {
+	if _, err := machinectl.RunCommandContext(ctx, outWriter, nil, "", "shell", machineName, "/usr/bin/kubeadm", "token", "create", kubeadmToken, "--ttl=0"); err != nil {
 		return errors.Wrap(err, "failed registering token")
 	}
 	return nil
 }
 
-func kubeadmJoin(kubeadmVersionStr, masterIP, machineName string, outWriter io.Writer) error {
+func kubeadmJoin(ctx context.Context, kubeadmVersionStr, masterIP, machineName string, outWriter io.Writer) error {
 	joinCmd := []string{
 		"/usr/bin/kubeadm",
 		"join",
@@ -720,7 +1079,7 @@ func kubeadmJoin(kubeadmVersionStr, masterIP, machineName string, outWriter io.W
 			"--discovery-token-unsafe-skip-ca-verification")
 	}
 	joinCmd = append(joinCmd, fmt.Sprintf("%s:6443", masterIP))
-	_, err = machinectl.RunCommand(outWriter, nil, "", "shell", machineName, joinCmd...)
+	_, err = machinectl.RunCommandContext(ctx, outWriter, nil, "", "shell", machineName, joinCmd...)
 	return err
 }
 
@@ -791,31 +1150,30 @@ func executeTemplateKubeadmConfig(kubeadmVersionStr string, clusterSettings *Clu
 	return buf, nil
 }
 
-func applyNetworkPlugin(kubectlPath, kubeconfigPath, cniConfigDirPath string, cniPlugin string, outWriter io.Writer) error {
+func applyNetworkPlugin(ctx context.Context, kubectlPath, kubeconfigPath, cniConfigDirPath string, cniPlugin string, outWriter io.Writer) error {
 	switch cniPlugin {
 	case "weave":
-		_, err := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", weaveNet).Output()
+		_, err := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", weaveNet).Output()
 		return err
 	case "flannel":
-		_, err := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", flannelNet).Output()
+		_, err := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", flannelNet).Output()
 		return err
 	case "canal":
-		_, err1 := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", canalRBAC).Output()
-		_, err2 := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", canalNet).Output()
+		_, err1 := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", canalRBAC).Output()
+		_, err2 := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", canalNet).Output()
 		if err1 != nil {
 			return err1
 		}
 		return err2
 	case "calico":
-		if _, err := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", calicoRBAC).Output(); err != nil {
+		if _, err := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", calicoRBAC).Output(); err != nil {
 			return err
 		}
-		_, err := exec.Command(kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", path.Join(cniConfigDirPath, "calico.yaml")).Output()
+		_, err := exec.CommandContext(ctx, kubectlPath, "--kubeconfig", kubeconfigPath, "apply", "-f", path.Join(cniConfigDirPath, "calico.yaml")).Output()
 		return err
 	default:
 		return errors.Errorf("Incorrect cni plugin %q", cniPlugin)
 	}
-	return nil
 }
 
 type kubeadmVersionType struct {
@@ -31,6 +31,12 @@ const DockerSystemdDropin = `[Service]
 Environment="DOCKER_OPTS=--exec-opt native.cgroupdriver=cgroupfs"
 `
 
+const ProxySystemdDropinTmpl = `[Service]
+{{ range . -}}
+Environment="{{ . }}"
+{{ end -}}
+`
+
 const RktletSystemdUnitTmpl = `[Unit]
 Description=rktlet: The rkt implementation of a Kubernetes Container Runtime
 Documentation=https://github.com/kubernetes-incubator/rktlet/tree/master/docs
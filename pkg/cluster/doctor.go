@@ -0,0 +1,71 @@
+package cluster
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+)
+
+// DoctorSettings describes the cluster the host is checked for
+type DoctorSettings struct {
+	// Dir is the kube-spawn asset directory
+	Dir          string
+	CNIPluginDir string
+	CNIPlugin    string
+	// BaseImage is the name of a built-in base image or the path to an
+	// image file, see bootstrap.GetBaseImage
+	BaseImage string
+	Nodes     int
+}
+
+// Doctor checks whether a cluster can be started on this host with the
+// given settings. It doesn't change anything, neither on the host nor in
+// the asset directory.
+func Doctor(settings *DoctorSettings) []bootstrap.Check {
+	checks := bootstrap.CheckHost(settings.Dir)
+	checks = append(checks, checkCNIPlugins(settings.CNIPluginDir, settings.CNIPlugin))
+
+	baseImage, err := bootstrap.GetBaseImage(settings.BaseImage)
+	if err != nil {
+		checks = append(checks, bootstrap.Check{
+			Name:    "base image",
+			Status:  bootstrap.CheckFail,
+			Message: err.Error(),
+			Hint:    fmt.Sprintf("use one of %s or the path to an image file with --base-image", strings.Join(bootstrap.BaseImageNames(), ", ")),
+		})
+		return append(checks, bootstrap.CheckPool(settings.BaseImage, settings.Nodes)...)
+	}
+	checks = append(checks, bootstrap.CheckBaseImage(baseImage))
+	return append(checks, bootstrap.CheckPool(baseImage.Name, settings.Nodes)...)
+}
+
+// checkCNIPlugins checks that the CNI plugin binaries copied into the
+// nodes exist
+func checkCNIPlugins(cniPluginDir, cniPlugin string) bootstrap.Check {
+	check := bootstrap.Check{Name: fmt.Sprintf("CNI plugins for %s", cniPlugin)}
+	files, ok := cniFiles[cniPlugin]
+	if !ok {
+		check.Status = bootstrap.CheckFail
+		check.Message = fmt.Sprintf("unknown CNI plugin %q", cniPlugin)
+		check.Hint = "use one of weave, flannel, calico or canal with --cni-plugin"
+		return check
+	}
+	var missing []string
+	for _, file := range append(cniFiles["base"], files...) {
+		if _, err := os.Stat(path.Join(cniPluginDir, file)); err != nil {
+			missing = append(missing, file)
+		}
+	}
+	if len(missing) > 0 {
+		check.Status = bootstrap.CheckFail
+		check.Message = fmt.Sprintf("missing in %s: %s", cniPluginDir, strings.Join(missing, " "))
+		check.Hint = "install the CNI plugins (https://github.com/containernetworking/plugins/releases) or point --cni-plugin-dir to them"
+		return check
+	}
+	check.Status = bootstrap.CheckOK
+	check.Message = fmt.Sprintf("all present in %s", cniPluginDir)
+	return check
+}
@@ -0,0 +1,143 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+// containerDataDirs are the directories of the container runtimes, which
+// are bind mounted from the machine rootfs dir into the nodes
+var containerDataDirs = []string{"var/lib/docker", "var/lib/rktlet"}
+
+// DiskUsage is the disk space allocated for a cluster in bytes. Files
+// hardlinked from the cache are counted, but shared with other clusters.
+type DiskUsage struct {
+	// BaseRootfs is the readonly rootfs of all base layers and node
+	// groups the nodes' overlays are based on
+	BaseRootfs int64
+	// Other is everything else in the cluster dir, like logs and
+	// kubeconfigs
+	Other int64
+	// Nodes is the usage of every machine, sorted by name
+	Nodes []NodeDiskUsage
+}
+
+// NodeDiskUsage is the disk space allocated for a machine of a cluster
+type NodeDiskUsage struct {
+	Name string
+	// Image is the machine image in /var/lib/machines
+	Image int64
+	// Rootfs is the upper dir of the machine's overlay mounts, without
+	// the container data
+	Rootfs int64
+	// Containers is the data of the container runtime, e.g. docker
+	// images and containers
+	Containers int64
+}
+
+func (u *NodeDiskUsage) Total() int64 {
+	return u.Image + u.Rootfs + u.Containers
+}
+
+// NodesTotal returns the usage of all nodes
+func (u *DiskUsage) NodesTotal() int64 {
+	var total int64
+	for _, node := range u.Nodes {
+		total += node.Total()
+	}
+	return total
+}
+
+func (u *DiskUsage) Total() int64 {
+	return u.BaseRootfs + u.Other + u.NodesTotal()
+}
+
+// DiskUsage determines the disk space allocated for the cluster dir and
+// the machine images of the cluster
+func (c *Cluster) DiskUsage() (*DiskUsage, error) {
+	usage := &DiskUsage{}
+	nodes := make(map[string]*NodeDiskUsage)
+	node := func(name string) *NodeDiskUsage {
+		if nodes[name] == nil {
+			nodes[name] = &NodeDiskUsage{Name: name}
+		}
+		return nodes[name]
+	}
+
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("cluster %q doesn't exist", c.name)
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		entryPath := path.Join(c.dir, entry.Name())
+		if entry.Name() == path.Base(c.MachineRootfsPath()) {
+			continue
+		}
+		entryUsage, err := fs.DiskUsage(entryPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to determine disk usage of %q", entryPath)
+		}
+		if strings.HasPrefix(entry.Name(), "rootfs-base-") || strings.HasPrefix(entry.Name(), "rootfs-group-") {
+			usage.BaseRootfs += entryUsage
+		} else {
+			usage.Other += entryUsage
+		}
+	}
+
+	machineDirs, err := ioutil.ReadDir(c.MachineRootfsPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, machineDir := range machineDirs {
+		machinePath := path.Join(c.MachineRootfsPath(), machineDir.Name())
+		total, err := fs.DiskUsage(machinePath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to determine disk usage of %q", machinePath)
+		}
+		n := node(machineDir.Name())
+		for _, dir := range containerDataDirs {
+			containerUsage, err := fs.DiskUsage(path.Join(machinePath, dir))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, errors.Wrapf(err, "failed to determine disk usage of %q", path.Join(machinePath, dir))
+			}
+			n.Containers += containerUsage
+		}
+		n.Rootfs = total - n.Containers
+	}
+
+	// Don't use ListImages, it would match the images of clusters whose
+	// name starts with the name of this cluster, too
+	images, err := machinectl.ListImagesByRegexp(fmt.Sprintf("^kube-spawn-%s-(master|worker)-", regexp.QuoteMeta(c.name)))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list machine images")
+	}
+	for _, image := range images {
+		imageUsage, err := bootstrap.ImageUsage(image.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to determine disk usage of image %q", image.Name)
+		}
+		node(image.Name).Image = imageUsage
+	}
+
+	for _, n := range nodes {
+		usage.Nodes = append(usage.Nodes, *n)
+	}
+	sort.Slice(usage.Nodes, func(i, j int) bool {
+		return usage.Nodes[i].Name < usage.Nodes[j].Name
+	})
+	return usage, nil
+}
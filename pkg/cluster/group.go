@@ -0,0 +1,49 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// taskGroup runs functions concurrently and cancels the context shared
+// by all of them as soon as the first one fails
+type taskGroup struct {
+	wg     sync.WaitGroup
+	cancel context.CancelFunc
+
+	mutex sync.Mutex
+	err   error
+}
+
+func newTaskGroup(ctx context.Context) (*taskGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &taskGroup{cancel: cancel}, ctx
+}
+
+func (g *taskGroup) Go(f func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := f(); err != nil {
+			g.mutex.Lock()
+			defer g.mutex.Unlock()
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			} else {
+				// Most likely a consequence of the cancellation,
+				// but log it anyway in case it isn't
+				log.Printf("%v", err)
+			}
+		}
+	}()
+}
+
+// Wait blocks until all functions have returned and returns the first
+// error, if any
+func (g *taskGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
@@ -0,0 +1,85 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/kubeconfig"
+)
+
+// KubeconfigContextName is the name of the context, cluster and user
+// entries added to user kubeconfigs by MergeKubeconfig
+func (c *Cluster) KubeconfigContextName() string {
+	return "kube-spawn-" + c.name
+}
+
+// mergedKubeconfigsPath lists the kubeconfig files the cluster
+// credentials were merged into, one per line, so that `Destroy` can
+// remove them again
+func (c *Cluster) mergedKubeconfigsPath() string {
+	return path.Join(c.dir, "merged-kubeconfigs")
+}
+
+func (c *Cluster) mergedKubeconfigs() ([]string, error) {
+	content, err := ioutil.ReadFile(c.mergedKubeconfigsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var paths []string
+	for _, line := range strings.Split(string(content), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			paths = append(paths, line)
+		}
+	}
+	return paths, nil
+}
+
+// MergeKubeconfig adds the admin credentials of the cluster as context
+// KubeconfigContextName() to the kubeconfig at kubeconfigPath, owned
+// by uid:gid
+func (c *Cluster) MergeKubeconfig(kubeconfigPath string, uid, gid int) error {
+	adminKubeconfig, err := ioutil.ReadFile(c.AdminKubeconfigPath())
+	if err != nil {
+		return errors.Wrap(err, "failed to read admin kubeconfig (is the cluster started?)")
+	}
+	if err := kubeconfig.Merge(kubeconfigPath, adminKubeconfig, c.KubeconfigContextName(), uid, gid); err != nil {
+		return err
+	}
+
+	paths, err := c.mergedKubeconfigs()
+	if err != nil {
+		return err
+	}
+	for _, p := range paths {
+		if p == kubeconfigPath {
+			return nil
+		}
+	}
+	paths = append(paths, kubeconfigPath)
+	return ioutil.WriteFile(c.mergedKubeconfigsPath(), []byte(strings.Join(paths, "\n")+"\n"), 0644)
+}
+
+// removeMergedKubeconfigs removes the cluster context from all
+// kubeconfigs it was merged into. A kubeconfig it can't be removed from,
+// e.g. because it was broken meanwhile, is only logged, so that it
+// doesn't prevent destroying the cluster.
+func (c *Cluster) removeMergedKubeconfigs() {
+	paths, err := c.mergedKubeconfigs()
+	if err != nil {
+		log.Printf("WARNING: failed to read the list of merged kubeconfigs: %v", err)
+		return
+	}
+	for _, p := range paths {
+		if err := kubeconfig.Remove(p, c.KubeconfigContextName()); err != nil {
+			log.Printf("WARNING: failed to remove context %q from %q: %v", c.KubeconfigContextName(), p, err)
+		}
+	}
+}
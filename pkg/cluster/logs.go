@@ -0,0 +1,74 @@
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// LogsPath returns the directory where the output of the bootstrap
+// script and kubeadm is kept, one subdirectory per machine
+func (c *Cluster) LogsPath() string {
+	return path.Join(c.dir, "logs")
+}
+
+func (c *Cluster) MachineLogsPath(machineName string) string {
+	return path.Join(c.LogsPath(), machineName)
+}
+
+// MachineLogs returns the paths of all captured log files of the given
+// machine. The machine doesn't have to be running anymore.
+func (c *Cluster) MachineLogs(machineName string) ([]string, error) {
+	entries, err := ioutil.ReadDir(c.MachineLogsPath(machineName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("no logs captured for machine %q", machineName)
+		}
+		return nil, err
+	}
+	var logs []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".log") {
+			logs = append(logs, path.Join(c.MachineLogsPath(machineName), entry.Name()))
+		}
+	}
+	sort.Strings(logs)
+	return logs, nil
+}
+
+// LoggedMachines returns the names of all machines logs were captured
+// for, including machines of previous runs which are gone already
+func (c *Cluster) LoggedMachines() ([]string, error) {
+	entries, err := ioutil.ReadDir(c.LogsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var machineNames []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			machineNames = append(machineNames, entry.Name())
+		}
+	}
+	return machineNames, nil
+}
+
+// createMachineLog creates (or truncates) the log file with the given
+// name for the machine, e.g. "bootstrap.log"
+func (c *Cluster) createMachineLog(machineName, logName string) (*os.File, error) {
+	if err := os.MkdirAll(c.MachineLogsPath(machineName), 0755); err != nil {
+		return nil, err
+	}
+	logPath := path.Join(c.MachineLogsPath(machineName), logName)
+	f, err := os.Create(logPath)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create log file %q", logPath)
+	}
+	return f, nil
+}
@@ -0,0 +1,130 @@
+package cluster
+
+import (
+	"context"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/cache"
+)
+
+const validNodeGroupNameRegexpStr = "^[a-z0-9]{1,20}$"
+
+var validNodeGroupNameRegexp = regexp.MustCompile(validNodeGroupNameRegexpStr)
+
+// NodeGroup is a set of worker nodes running a different Kubernetes
+// version than the rest of the cluster, e.g. to test version skew
+// between kubelets and the control plane. Every node group has its own
+// base rootfs.
+type NodeGroup struct {
+	Name              string `json:"name"`
+	KubernetesVersion string `json:"kubernetesVersion"`
+}
+
+func validateNodeGroups(nodeGroups []NodeGroup) error {
+	seen := make(map[string]bool)
+	for _, nodeGroup := range nodeGroups {
+		if !validNodeGroupNameRegexp.MatchString(nodeGroup.Name) {
+			return errors.Errorf("got invalid node group name %q (expected %q)", nodeGroup.Name, validNodeGroupNameRegexpStr)
+		}
+		if seen[nodeGroup.Name] {
+			return errors.Errorf("node group %q given more than once", nodeGroup.Name)
+		}
+		seen[nodeGroup.Name] = true
+		if _, err := semver.NewVersion(nodeGroup.KubernetesVersion); err != nil {
+			return errors.Wrapf(err, "invalid Kubernetes version %q for node group %q", nodeGroup.KubernetesVersion, nodeGroup.Name)
+		}
+	}
+	return nil
+}
+
+// NodeGroupRootfsPath returns the path of the base rootfs of the given
+// node group
+func (c *Cluster) NodeGroupRootfsPath(nodeGroup string) string {
+	return path.Join(c.dir, "rootfs-group-"+nodeGroup)
+}
+
+// MachineNodeGroup returns the node group of the given machine or an
+// empty string for machines not in a node group. Machines of node
+// groups are named `kube-spawn-<cluster>-worker-<group>-<random>`.
+func (c *Cluster) MachineNodeGroup(machineName string) string {
+	parts := strings.Split(c.ShortMachineName(machineName), "-")
+	if len(parts) == 3 && parts[0] == "worker" {
+		return parts[1]
+	}
+	return ""
+}
+
+// machineLowerRootfsPath returns the readonly rootfs the machine's
+// overlay mounts are based on
+func (c *Cluster) machineLowerRootfsPath(machineName string) string {
+	if nodeGroup := c.MachineNodeGroup(machineName); nodeGroup != "" {
+		return c.NodeGroupRootfsPath(nodeGroup)
+	}
+	return c.BaseRootfsPath()
+}
+
+// createNodeGroups creates the base rootfs of every node group from the
+// cluster's base rootfs and the Kubernetes binaries of the group's version
+func (c *Cluster) createNodeGroups(ctx context.Context, clusterSettings *ClusterSettings, clusterCache *cache.Cache) error {
+	for _, nodeGroup := range clusterSettings.NodeGroups {
+		if err := bootstrap.DownloadKubernetesBinaries(ctx, nodeGroup.KubernetesVersion, clusterCache); err != nil {
+			return errors.Wrapf(err, "failed to download Kubernetes binaries for node group %q", nodeGroup.Name)
+		}
+		groupSettings := *clusterSettings
+		groupSettings.KubernetesVersion = nodeGroup.KubernetesVersion
+		groupSettings.KubernetesSourceDir = ""
+		if err := c.stageBaseRootfsLayer(c.NodeGroupRootfsPath(nodeGroup.Name), bootstrap.KubernetesCacheDir(clusterCache, nodeGroup.KubernetesVersion), &groupSettings); err != nil {
+			return errors.Wrapf(err, "failed to create rootfs of node group %q", nodeGroup.Name)
+		}
+	}
+	return nil
+}
+
+// nodeGroupMachineNames returns the names for the machines to start in
+// the given node groups, sorted by group name for a stable order
+func (c *Cluster) nodeGroupMachineNames(nodeGroupSizes map[string]int) ([]string, error) {
+	if len(nodeGroupSizes) == 0 {
+		return nil, nil
+	}
+	state, err := c.State()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool)
+	for _, nodeGroup := range state.ClusterSettings.NodeGroups {
+		known[nodeGroup.Name] = true
+	}
+
+	var groupNames []string
+	for name := range nodeGroupSizes {
+		if !known[name] {
+			return nil, errors.Errorf("cluster %q has no node group %q (node groups are defined with `create --node-group`)", c.name, name)
+		}
+		groupNames = append(groupNames, name)
+	}
+	sort.Strings(groupNames)
+
+	var machineNames []string
+	for _, name := range groupNames {
+		if nodeGroupSizes[name] < 0 {
+			return nil, errors.Errorf("invalid size %d for node group %q", nodeGroupSizes[name], name)
+		}
+		for i := 0; i < nodeGroupSizes[name]; i++ {
+			machineNames = append(machineNames, c.machineName("worker-"+name))
+		}
+	}
+	return machineNames, nil
+}
+
+// machineName returns a new machine name with the given role, e.g.
+// `kube-spawn-default-worker-fpllng` for role "worker"
+func (c *Cluster) machineName(role string) string {
+	return "kube-spawn-" + c.name + "-" + role + "-" + randString(6)
+}
@@ -0,0 +1,90 @@
+package cluster
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+const (
+	// kubeadm's default service subnet
+	defaultServiceCIDR = "10.96.0.0/12"
+
+	proxyDropinName = "30-kube-spawn-proxy.conf"
+)
+
+// clusterNoProxy are the addresses inside the cluster which must not be
+// reached through a proxy
+var clusterNoProxy = []string{
+	"localhost",
+	"127.0.0.1",
+	"10.22.0.0/16",
+	defaultServiceCIDR,
+	".svc",
+	".cluster.local",
+}
+
+// proxyEnvironment returns the proxy variables for the services on the
+// nodes, or nil if no proxy is configured. NO_PROXY is extended by the
+// cluster's own networks.
+func proxyEnvironment(clusterSettings *ClusterSettings) []string {
+	if clusterSettings.ProxyEnv["HTTP_PROXY"] == "" && clusterSettings.ProxyEnv["HTTPS_PROXY"] == "" {
+		return nil
+	}
+
+	noProxy := append([]string{}, clusterNoProxy...)
+	for _, cidr := range []string{clusterSettings.PodNetworkCIDR, clusterSettings.ClusterCIDR} {
+		if cidr != "" {
+			noProxy = append(noProxy, cidr)
+		}
+	}
+	if value := clusterSettings.ProxyEnv["NO_PROXY"]; value != "" {
+		noProxy = append(strings.Split(value, ","), noProxy...)
+	}
+
+	var env []string
+	for name, value := range clusterSettings.ProxyEnv {
+		if name == "NO_PROXY" {
+			continue
+		}
+		env = append(env, name+"="+value, strings.ToLower(name)+"="+value)
+	}
+	joined := strings.Join(noProxy, ",")
+	env = append(env, "NO_PROXY="+joined, "no_proxy="+joined)
+	sort.Strings(env)
+	return env
+}
+
+// systemdEnvEscaper escapes a value for a quoted Environment= line, where
+// systemd expands `%` specifiers and C-style escapes
+var systemdEnvEscaper = strings.NewReplacer(`%`, `%%`, `\`, `\\`, `"`, `\"`)
+
+// writeProxyDropins writes systemd drop-ins which pass the proxy
+// settings to the container runtime and the kubelet. Proxy URLs may
+// contain credentials, so the drop-ins are only readable by root.
+func writeProxyDropins(rootfsDir string, clusterSettings *ClusterSettings) error {
+	env := proxyEnvironment(clusterSettings)
+	if env == nil {
+		return nil
+	}
+	for i := range env {
+		env[i] = systemdEnvEscaper.Replace(env[i])
+	}
+	buf, err := ExecuteTemplate(ProxySystemdDropinTmpl, env)
+	if err != nil {
+		return err
+	}
+	units := []string{"kubelet.service", "docker.service"}
+	if clusterSettings.ContainerRuntime == "rkt" {
+		units = append(units, "rktlet.service")
+	}
+	for _, unit := range units {
+		dropinPath := path.Join(rootfsDir, "etc/systemd/system", unit+".d", proxyDropinName)
+		if err := fs.CreatePrivateFileFromString(dropinPath, buf.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const readinessPollInterval = 5 * time.Second
+
+type nodeList struct {
+	Items []struct {
+		Metadata struct {
+			Name string `json:"name"`
+		} `json:"metadata"`
+		Status struct {
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+type podList struct {
+	Items []struct {
+		Metadata struct {
+			Name      string `json:"name"`
+			Namespace string `json:"namespace"`
+		} `json:"metadata"`
+		Status struct {
+			Phase      string `json:"phase"`
+			Conditions []struct {
+				Type   string `json:"type"`
+				Status string `json:"status"`
+			} `json:"conditions"`
+		} `json:"status"`
+	} `json:"items"`
+}
+
+// readinessStatus is a snapshot of the cluster health as seen through
+// the API server
+type readinessStatus struct {
+	nodesReady int
+	nodesTotal int
+	podsReady  int
+	podsTotal  int
+	// unhealthy lists the components which are not ready yet,
+	// e.g. "node kube-spawn-default-worker-fpllng (NotReady)"
+	unhealthy []string
+}
+
+func (s *readinessStatus) String() string {
+	return fmt.Sprintf("%d/%d nodes ready, %d/%d kube-system pods running", s.nodesReady, s.nodesTotal, s.podsReady, s.podsTotal)
+}
+
+func kubectlGetJSON(ctx context.Context, kubectlPath, kubeconfigPath string, v interface{}, args ...string) error {
+	cmdArgs := append([]string{"--kubeconfig", kubeconfigPath, "get", "-o", "json"}, args...)
+	out, err := exec.CommandContext(ctx, kubectlPath, cmdArgs...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return errors.Errorf("kubectl get %s failed: %s", strings.Join(args, " "), strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return errors.Wrapf(err, "kubectl get %s failed", strings.Join(args, " "))
+	}
+	return json.Unmarshal(out, v)
+}
+
+func getReadinessStatus(ctx context.Context, kubectlPath, kubeconfigPath string, expectedNodes int) (*readinessStatus, error) {
+	var nodes nodeList
+	if err := kubectlGetJSON(ctx, kubectlPath, kubeconfigPath, &nodes, "nodes"); err != nil {
+		return nil, err
+	}
+	var pods podList
+	if err := kubectlGetJSON(ctx, kubectlPath, kubeconfigPath, &pods, "pods", "--namespace", "kube-system"); err != nil {
+		return nil, err
+	}
+
+	status := &readinessStatus{
+		nodesTotal: expectedNodes,
+		podsTotal:  len(pods.Items),
+	}
+
+	if len(nodes.Items) < expectedNodes {
+		status.unhealthy = append(status.unhealthy, fmt.Sprintf("only %d of %d nodes registered", len(nodes.Items), expectedNodes))
+	}
+	for _, node := range nodes.Items {
+		ready := false
+		for _, cond := range node.Status.Conditions {
+			if cond.Type == "Ready" && cond.Status == "True" {
+				ready = true
+			}
+		}
+		if ready {
+			status.nodesReady++
+		} else {
+			status.unhealthy = append(status.unhealthy, fmt.Sprintf("node %s (NotReady)", node.Metadata.Name))
+		}
+	}
+
+	for _, pod := range pods.Items {
+		ready := pod.Status.Phase == "Succeeded"
+		if pod.Status.Phase == "Running" {
+			for _, cond := range pod.Status.Conditions {
+				if cond.Type == "Ready" && cond.Status == "True" {
+					ready = true
+				}
+			}
+		}
+		if ready {
+			status.podsReady++
+		} else {
+			status.unhealthy = append(status.unhealthy, fmt.Sprintf("pod %s/%s (%s)", pod.Metadata.Namespace, pod.Metadata.Name, pod.Status.Phase))
+		}
+	}
+	if status.podsTotal == 0 {
+		status.unhealthy = append(status.unhealthy, "no kube-system pods found")
+	}
+
+	sort.Strings(status.unhealthy)
+	return status, nil
+}
+
+// waitClusterReady polls the API server with the admin kubeconfig until
+// all expected nodes are Ready and all pods in kube-system are running.
+// Progress is written to outWriter whenever the status changes.
+func waitClusterReady(ctx context.Context, kubectlPath, kubeconfigPath string, expectedNodes int, timeout time.Duration, outWriter io.Writer) error {
+	deadline := time.Now().Add(timeout)
+
+	var (
+		lastProgress string
+		lastErr      error
+		unhealthy    []string
+	)
+	for {
+		status, err := getReadinessStatus(ctx, kubectlPath, kubeconfigPath, expectedNodes)
+		if err != nil {
+			// The API server might not be reachable yet, keep trying
+			// until the deadline is reached
+			lastErr = err
+		} else {
+			lastErr = nil
+			unhealthy = status.unhealthy
+			if progress := status.String(); progress != lastProgress {
+				fmt.Fprintf(outWriter, "%s\n", progress)
+				lastProgress = progress
+			}
+			if len(status.unhealthy) == 0 {
+				return nil
+			}
+		}
+
+		if time.Now().Add(readinessPollInterval).After(deadline) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(readinessPollInterval):
+		}
+	}
+
+	if lastErr != nil {
+		return errors.Wrapf(lastErr, "cluster not ready after %s", timeout)
+	}
+	return errors.Errorf("cluster not ready after %s: %s", timeout, strings.Join(unhealthy, ", "))
+}
@@ -0,0 +1,133 @@
+package cluster
+
+import (
+	"context"
+	"log"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+// reloadComponents maps the binaries which can be reloaded to the units
+// which have to be restarted afterwards
+var reloadComponents = map[string][]string{
+	"kubelet": {"kubelet.service"},
+	"kubeadm": nil,
+	"kubectl": nil,
+}
+
+// ReloadComponents returns the names of the binaries Reload can replace
+func ReloadComponents() []string {
+	return []string{"kubelet", "kubeadm", "kubectl"}
+}
+
+// ReloadSettings holds the options for replacing binaries of a running
+// cluster with locally built ones
+type ReloadSettings struct {
+	KubernetesSourceDir string
+	// Components are the binaries to replace, e.g. "kubelet"
+	Components []string
+}
+
+// Reload copies the given components from the `_output` directory of
+// the Kubernetes source dir into the base rootfs, where the running
+// nodes see them through their overlay mounts, and restarts the affected
+// units on every node. Workers of node groups are left alone.
+func (c *Cluster) Reload(ctx context.Context, reloadSettings *ReloadSettings) error {
+	if len(reloadSettings.Components) == 0 {
+		return errors.Errorf("no components to reload given")
+	}
+	var units []string
+	for _, component := range reloadSettings.Components {
+		componentUnits, ok := reloadComponents[component]
+		if !ok {
+			return errors.Errorf("cannot reload unknown component %q (expected one of %s)", component, strings.Join(ReloadComponents(), ", "))
+		}
+		units = append(units, componentUnits...)
+	}
+
+	binaryDir, err := KubernetesSourceBinaryDir(reloadSettings.KubernetesSourceDir)
+	if err != nil {
+		return err
+	}
+
+	machines, err := c.Machines()
+	if err != nil {
+		return errors.Wrap(err, "failed to list machines")
+	}
+	var nodes []string
+	for _, machine := range machines {
+		if c.MachineNodeGroup(machine.Name) == "" {
+			nodes = append(nodes, machine.Name)
+		}
+	}
+
+	for _, component := range reloadSettings.Components {
+		src := path.Join(binaryDir, component)
+		dst := path.Join(c.BaseRootfsPath(), "usr/bin", component)
+		if err := replaceFile(src, dst); err != nil {
+			return errors.Wrapf(err, "failed to reload %s", component)
+		}
+
+		// Nodes which got the file installed into their upper dir
+		// (e.g. by `upgrade`) don't see the base rootfs version
+		for _, node := range nodes {
+			shadowPath := path.Join(c.MachineRootfsPath(), node, "usr/bin", component)
+			if exists, err := fs.PathExists(shadowPath); err != nil {
+				return err
+			} else if exists {
+				if err := installFile(ctx, node, src, path.Join("/usr/bin", component)); err != nil {
+					return errors.Wrapf(err, "failed to install %s on %s", component, node)
+				}
+			}
+		}
+		log.Printf("Reloaded %s from %s", component, src)
+	}
+
+	if len(units) == 0 {
+		return nil
+	}
+	group, groupCtx := newTaskGroup(ctx)
+	for _, node := range nodes {
+		node := node
+		group.Go(func() error {
+			restartCmd := append([]string{"/usr/bin/systemctl", "restart"}, units...)
+			if err := machinectl.ExecContext(groupCtx, node, restartCmd...); err != nil {
+				return errors.Wrapf(err, "failed to restart %s on %s", strings.Join(units, " "), node)
+			}
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return err
+	}
+	log.Printf("Restarted %s on %d nodes", strings.Join(units, " "), len(nodes))
+	return nil
+}
+
+// replaceFile copies src next to dst and renames it over dst, so that
+// binaries in use can be replaced and readers never see a partial file
+func replaceFile(src, dst string) error {
+	info, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	tmpPath := dst + ".kube-spawn-new"
+	if err := fs.CopyFile(src, tmpPath); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, info.Mode().Perm()); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package cluster
+
+import (
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+)
+
+// machineSet records what a single `Start` invocation created, so that
+// it can be torn down again if the start fails
+type machineSet struct {
+	mutex           sync.Mutex
+	machines        map[string]bool
+	adminKubeconfig bool
+}
+
+func (m *machineSet) add(machineName string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.machines == nil {
+		m.machines = make(map[string]bool)
+	}
+	m.machines[machineName] = true
+}
+
+func (m *machineSet) names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for name := range m.machines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (m *machineSet) contains(machineName string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.machines[machineName]
+}
+
+// rollback removes the machines, images, CNI leases and machine rootfs
+// directories recorded in the given set. Machines of the cluster which
+// were not created by the failed invocation are left alone.
+func (c *Cluster) rollback(created *machineSet) error {
+	machines, err := c.Machines()
+	if err != nil {
+		return errors.Wrap(err, "failed to list machines")
+	}
+	var running []machinectl.Machine
+	for _, machine := range machines {
+		if created.contains(machine.Name) {
+			running = append(running, machine)
+		}
+	}
+
+	var rollbackErrors []string
+
+	if err := stopMachines(running, 30*time.Second); err != nil {
+		rollbackErrors = append(rollbackErrors, err.Error())
+	}
+
+	// The leases are recorded with the machine name as container ID, so
+	// they are found for machines which failed or exited early, too
+	for _, name := range created.names() {
+		if err := bootstrap.ReleaseNetworkLeases(name); err != nil {
+			rollbackErrors = append(rollbackErrors, err.Error())
+		}
+	}
+
+	var images []machinectl.Image
+	for _, name := range created.names() {
+		if machinectl.ImageExists(name) {
+			images = append(images, machinectl.Image{Name: name})
+		}
+	}
+	removeImages(images, 30*time.Second)
+	for _, image := range images {
+		if machinectl.ImageExists(image.Name) {
+			rollbackErrors = append(rollbackErrors, errors.Errorf("failed to remove image %q", image.Name).Error())
+		}
+	}
+
+	for _, name := range created.names() {
+		machineRootfs := path.Join(c.MachineRootfsPath(), name)
+		if err := os.RemoveAll(machineRootfs); err != nil {
+			rollbackErrors = append(rollbackErrors, errors.Wrapf(err, "failed to remove %q", machineRootfs).Error())
+		}
+	}
+
+	if created.adminKubeconfig {
+		if err := os.Remove(c.AdminKubeconfigPath()); err != nil && !os.IsNotExist(err) {
+			rollbackErrors = append(rollbackErrors, errors.Wrapf(err, "failed to remove %q", c.AdminKubeconfigPath()).Error())
+		}
+	}
+
+	if len(rollbackErrors) > 0 {
+		return errors.Errorf("%d errors during rollback: %v", len(rollbackErrors), rollbackErrors)
+	}
+	return nil
+}
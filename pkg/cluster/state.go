@@ -0,0 +1,56 @@
+package cluster
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+// State is the persisted configuration of a cluster. It is written by
+// Create and updated by operations changing the cluster, like Upgrade.
+type State struct {
+	ClusterSettings *ClusterSettings `json:"clusterSettings"`
+}
+
+func (c *Cluster) statePath() string {
+	return path.Join(c.dir, "cluster.json")
+}
+
+// State reads the cluster state file
+func (c *Cluster) State() (*State, error) {
+	content, err := ioutil.ReadFile(c.statePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("cluster %q has no state file %q (created with an older version of kube-spawn?)", c.name, c.statePath())
+		}
+		return nil, err
+	}
+	var state State
+	if err := json.Unmarshal(content, &state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse %q", c.statePath())
+	}
+	if state.ClusterSettings == nil {
+		return nil, errors.Errorf("no cluster settings in %q", c.statePath())
+	}
+	return &state, nil
+}
+
+// saveState replaces the cluster state file atomically
+func (c *Cluster) saveState(state *State) error {
+	content, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmpPath := c.statePath() + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, append(content, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write %q", tmpPath)
+	}
+	if err := os.Rename(tmpPath, c.statePath()); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "failed to write %q", c.statePath())
+	}
+	return nil
+}
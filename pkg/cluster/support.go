@@ -0,0 +1,262 @@
+package cluster
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+const redacted = "REDACTED"
+
+var redactRegexps = []struct {
+	exp         *regexp.Regexp
+	replacement string
+}{
+	// kubeconfig and kubelet config credentials, e.g.
+	// `client-key-data: LS0tLS1CRUdJTi...`
+	{regexp.MustCompile(`(?m)^(\s*-?\s*"?(client-key-data|client-certificate-data|token|password|secret)"?\s*:\s*).+$`), "${1}" + redacted},
+	{regexp.MustCompile(`(?s)-----BEGIN [A-Z ]*PRIVATE KEY-----.*?-----END [A-Z ]*PRIVATE KEY-----`), "-----" + redacted + " PRIVATE KEY-----"},
+	// kubeadm bootstrap tokens
+	{regexp.MustCompile(`\b[a-z0-9]{6}\.[a-z0-9]{16}\b`), redacted},
+	{regexp.MustCompile(`(Authorization: Bearer )\S+`), "${1}" + redacted},
+}
+
+// redact replaces credentials like private keys and tokens in the given
+// text
+func redact(content []byte) []byte {
+	for _, r := range redactRegexps {
+		content = r.exp.ReplaceAll(content, []byte(r.replacement))
+	}
+	return content
+}
+
+// supportBundle collects files into a gzipped tarball. Errors while
+// gathering individual items don't abort the collection, they are
+// recorded in `errors.txt` in the bundle instead.
+type supportBundle struct {
+	tarWriter *tar.Writer
+	prefix    string
+	errors    []string
+}
+
+func (b *supportBundle) addFile(name string, content []byte) error {
+	content = redact(content)
+	header := &tar.Header{
+		Name:    path.Join(b.prefix, name),
+		Mode:    0644,
+		Size:    int64(len(content)),
+		ModTime: time.Now(),
+	}
+	if err := b.tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := b.tarWriter.Write(content)
+	return err
+}
+
+func (b *supportBundle) recordError(name string, err error) {
+	b.errors = append(b.errors, fmt.Sprintf("%s: %v", name, err))
+}
+
+// addCommand runs the command and adds its combined output. The output
+// is added even if the command fails, as it usually tells why.
+func (b *supportBundle) addCommand(ctx context.Context, name string, command string, args ...string) error {
+	out, cmdErr := exec.CommandContext(ctx, command, args...).CombinedOutput()
+	if cmdErr != nil {
+		b.recordError(name, errors.Wrapf(cmdErr, "%s %s", command, strings.Join(args, " ")))
+	}
+	return b.addFile(name, out)
+}
+
+// addHostFile adds a file from the host. Missing files are recorded as
+// errors.
+func (b *supportBundle) addHostFile(name, hostPath string) error {
+	content, err := ioutil.ReadFile(hostPath)
+	if err != nil {
+		b.recordError(name, err)
+		return nil
+	}
+	return b.addFile(name, content)
+}
+
+// addHostDir adds all regular files below hostDir
+func (b *supportBundle) addHostDir(name, hostDir string) error {
+	if exists, err := fs.PathExists(hostDir); err != nil || !exists {
+		if err != nil {
+			b.recordError(name, err)
+		}
+		return nil
+	}
+	return filepath.Walk(hostDir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			b.recordError(name, err)
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(hostDir, p)
+		if err != nil {
+			return err
+		}
+		return b.addHostFile(path.Join(name, rel), p)
+	})
+}
+
+// WriteSupportBundle gathers information useful for debugging a broken
+// cluster into a gzipped tarball written to w:
+//
+//   - host state: iptables rules, CNI configuration, machined machines and
+//     images, storage pool usage
+//   - cluster files: generated configuration and captured bootstrap and
+//     kubeadm logs
+//   - per node: journal and kubelet configuration
+//   - `kubectl get` dumps, if the API server is reachable
+//
+// Private keys, tokens and kubeconfig credentials are redacted.
+func (c *Cluster) WriteSupportBundle(ctx context.Context, w io.Writer) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	bundle := &supportBundle{
+		tarWriter: tarWriter,
+		prefix:    fmt.Sprintf("kube-spawn-%s-support", c.name),
+	}
+
+	if err := c.collectSupportBundle(ctx, bundle); err != nil {
+		return err
+	}
+
+	if len(bundle.errors) > 0 {
+		if err := bundle.addFile("errors.txt", []byte(strings.Join(bundle.errors, "\n")+"\n")); err != nil {
+			return err
+		}
+	}
+
+	if err := tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func (c *Cluster) collectSupportBundle(ctx context.Context, bundle *supportBundle) error {
+	// host state
+	if err := bundle.addCommand(ctx, "host/iptables-save.txt", "iptables-save"); err != nil {
+		return err
+	}
+	if err := bundle.addHostDir("host/cni-net.d", path.Dir(bootstrap.NspawnNetPath)); err != nil {
+		return err
+	}
+	if err := bundle.addCommand(ctx, "host/machinectl-list.txt", "machinectl", "list", "--no-legend"); err != nil {
+		return err
+	}
+	if err := bundle.addCommand(ctx, "host/machinectl-list-images.txt", "machinectl", "list-images", "--no-legend"); err != nil {
+		return err
+	}
+	if err := bundle.addCommand(ctx, "host/uname.txt", "uname", "-a"); err != nil {
+		return err
+	}
+	if err := bundle.addCommand(ctx, "host/systemd-version.txt", "systemctl", "--version"); err != nil {
+		return err
+	}
+	if poolUsage, err := bootstrap.GetPoolUsage(true); err != nil {
+		bundle.recordError("host/pool.txt", err)
+	} else {
+		var buf bytes.Buffer
+		fmt.Fprintf(&buf, "pool image exists: %t\n", poolUsage.ImageExists)
+		fmt.Fprintf(&buf, "pool image allocated: %d\n", poolUsage.ImageAllocated)
+		fmt.Fprintf(&buf, "pool size: %d\n", poolUsage.Size)
+		fmt.Fprintf(&buf, "pool free: %d\n", poolUsage.Free)
+		fmt.Fprintf(&buf, "pool mounted: %t\n", poolUsage.Mounted)
+		fmt.Fprintf(&buf, "host free: %d\n", poolUsage.HostFree)
+		for _, image := range poolUsage.Images {
+			fmt.Fprintf(&buf, "image %s: %d\n", image.Name, image.Usage)
+		}
+		if err := bundle.addFile("host/pool.txt", buf.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	// cluster files
+	for _, f := range []string{
+		"opt/kube-spawn/bootstrap.sh",
+		"etc/kubeadm/kubeadm.yml",
+		"etc/docker/daemon.json",
+		"etc/systemd/system/kubelet.service",
+		"etc/systemd/system/kubelet.service.d/10-kubeadm.conf",
+		"etc/systemd/system/kubelet.service.d/20-kube-spawn.conf",
+	} {
+		if err := bundle.addHostFile(path.Join("cluster/rootfs-base", f), path.Join(c.BaseRootfsPath(), f)); err != nil {
+			return err
+		}
+	}
+	if err := bundle.addHostDir("cluster/logs", c.LogsPath()); err != nil {
+		return err
+	}
+
+	// nodes
+	machines, err := c.Machines()
+	if err != nil {
+		bundle.recordError("nodes", err)
+	}
+	for _, machine := range machines {
+		nodeDir := path.Join("nodes", machine.Name)
+
+		var journal bytes.Buffer
+		if err := machinectl.Journal(ctx, &journal, machine.Name); err != nil {
+			bundle.recordError(path.Join(nodeDir, "journal.txt"), err)
+		}
+		if err := bundle.addFile(path.Join(nodeDir, "journal.txt"), journal.Bytes()); err != nil {
+			return err
+		}
+
+		machineRootfs := path.Join(c.MachineRootfsPath(), machine.Name)
+		if err := bundle.addHostFile(path.Join(nodeDir, "kubelet-config.yaml"), path.Join(machineRootfs, "var/lib/kubelet/config.yaml")); err != nil {
+			return err
+		}
+		if err := bundle.addHostFile(path.Join(nodeDir, "kubeadm-flags.env"), path.Join(machineRootfs, "var/lib/kubelet/kubeadm-flags.env")); err != nil {
+			return err
+		}
+	}
+
+	// kubectl dumps
+	if exists, _ := fs.PathExists(c.AdminKubeconfigPath()); !exists {
+		bundle.recordError("kubectl", errors.Errorf("no admin kubeconfig at %q", c.AdminKubeconfigPath()))
+		return nil
+	}
+	kubectlPath := path.Join(c.BaseRootfsPath(), "usr/bin/kubectl")
+	for _, dump := range []struct {
+		name string
+		args []string
+	}{
+		{"kubectl/nodes.txt", []string{"get", "nodes", "-o", "wide"}},
+		{"kubectl/describe-nodes.txt", []string{"describe", "nodes"}},
+		{"kubectl/pods.txt", []string{"get", "pods", "--all-namespaces", "-o", "wide"}},
+		{"kubectl/describe-pods-kube-system.txt", []string{"describe", "pods", "--namespace", "kube-system"}},
+		{"kubectl/events.txt", []string{"get", "events", "--all-namespaces"}},
+	} {
+		args := append([]string{"--kubeconfig", c.AdminKubeconfigPath(), "--request-timeout", "10s"}, dump.args...)
+		if err := bundle.addCommand(ctx, dump.name, kubectlPath, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,325 @@
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/semver"
+	"github.com/pkg/errors"
+
+	"github.com/kinvolk/kube-spawn/pkg/bootstrap"
+	"github.com/kinvolk/kube-spawn/pkg/cache"
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/multiprint"
+	"github.com/kinvolk/kube-spawn/pkg/utils/fs"
+)
+
+// UpgradeSettings holds the options for upgrading a running cluster
+type UpgradeSettings struct {
+	KubernetesVersion string
+	// DrainTimeout is passed to `kubectl drain` for every worker
+	DrainTimeout time.Duration
+}
+
+// upgradeFiles are the files (relative to the rootfs) which are replaced
+// on the nodes during an upgrade
+var upgradeFiles = []string{
+	"usr/bin/kubelet",
+	"usr/bin/kubeadm",
+	"usr/bin/kubectl",
+	"etc/systemd/system/kubelet.service",
+	"etc/systemd/system/kubelet.service.d/10-kubeadm.conf",
+	"etc/systemd/system/kubelet.service.d/20-kube-spawn.conf",
+	"etc/kubeadm/kubeadm.yml",
+}
+
+// baseRootfsLayerPath returns the path of the base rootfs layer for the
+// given Kubernetes version. After an upgrade, BaseRootfsPath is a symlink
+// to the layer of the current version.
+func (c *Cluster) baseRootfsLayerPath(kubernetesVersion string) string {
+	return path.Join(c.dir, fmt.Sprintf("rootfs-base-%s", kubernetesVersion))
+}
+
+// Upgrade upgrades a running cluster to a new Kubernetes version. It..
+//
+//   - downloads the Kubernetes binaries of the new version into the cache
+//   - stages them into a new base rootfs layer, which is used for nodes
+//     started later on
+//   - installs the new binaries on the master and runs
+//     `kubeadm upgrade apply`
+//   - upgrades the workers one at a time: drain, install the new binaries,
+//     `kubeadm upgrade node`, restart the kubelet and uncordon. Workers
+//     of node groups keep their version.
+//   - updates the cluster state file
+//
+// Running nodes keep the previous base rootfs layer mounted, it is
+// removed on the next Stop.
+func (c *Cluster) Upgrade(ctx context.Context, upgradeSettings *UpgradeSettings, clusterCache *cache.Cache) error {
+	state, err := c.State()
+	if err != nil {
+		return err
+	}
+	if err := checkArch(state.ClusterSettings); err != nil {
+		return err
+	}
+
+	currentVersionStr, err := kubeadmGitVersion(path.Join(c.BaseRootfsPath(), "usr/bin/kubeadm"))
+	if err != nil {
+		return errors.Wrap(err, "failed to determine current kubeadm version")
+	}
+	currentVersion, err := semver.NewVersion(currentVersionStr)
+	if err != nil {
+		return err
+	}
+	targetVersion, err := semver.NewVersion(upgradeSettings.KubernetesVersion)
+	if err != nil {
+		return errors.Wrapf(err, "invalid Kubernetes version %q", upgradeSettings.KubernetesVersion)
+	}
+	if !targetVersion.GreaterThan(currentVersion) {
+		return errors.Errorf("cluster %q runs %s already, cannot upgrade to %s", c.name, currentVersionStr, upgradeSettings.KubernetesVersion)
+	}
+
+	masterMachines, err := c.MasterMachines()
+	if err != nil {
+		return errors.Wrap(err, "failed to get list of master machines")
+	}
+	if len(masterMachines) == 0 {
+		return errors.Errorf("no master machine running in cluster %q", c.name)
+	}
+	workerMachines, err := c.WorkerMachines()
+	if err != nil {
+		return errors.Wrap(err, "failed to get list of worker machines")
+	}
+	sort.Slice(workerMachines, func(i, j int) bool {
+		return workerMachines[i].Name < workerMachines[j].Name
+	})
+
+	log.Printf("Upgrading cluster %q from %s to %s ...", c.name, currentVersionStr, upgradeSettings.KubernetesVersion)
+
+	if err := bootstrap.DownloadKubernetesBinaries(ctx, upgradeSettings.KubernetesVersion, clusterCache); err != nil {
+		return errors.Wrap(err, "failed to download required Kubernetes binaries")
+	}
+
+	clusterSettings := *state.ClusterSettings
+	clusterSettings.KubernetesVersion = upgradeSettings.KubernetesVersion
+	clusterSettings.KubernetesSourceDir = ""
+
+	layerPath := c.baseRootfsLayerPath(upgradeSettings.KubernetesVersion)
+	if err := c.stageBaseRootfsLayer(layerPath, bootstrap.KubernetesCacheDir(clusterCache, upgradeSettings.KubernetesVersion), &clusterSettings); err != nil {
+		return errors.Wrap(err, "failed to stage base rootfs layer")
+	}
+
+	multiPrinter := multiprint.New(ctx)
+	multiPrinter.RunPrintLoop()
+	defer multiPrinter.Close()
+
+	master := masterMachines[0].Name
+	if err := c.upgradeMachine(ctx, master, layerPath, multiPrinter, func(outWriter io.Writer) error {
+		applyCmd := []string{"/usr/bin/kubeadm", "upgrade", "apply", "-y", upgradeSettings.KubernetesVersion}
+		applyCmd = append(applyCmd, kubeadmPreflightFlags(targetVersion)...)
+		_, err := machinectl.RunCommandContext(ctx, outWriter, outWriter, "", "shell", master, applyCmd...)
+		return errors.Wrap(err, "kubeadm upgrade apply failed")
+	}); err != nil {
+		return err
+	}
+
+	kubectlPath := path.Join(layerPath, "usr/bin/kubectl")
+	for _, worker := range workerMachines {
+		worker := worker.Name
+		// Node groups are pinned to their own Kubernetes version
+		if nodeGroup := c.MachineNodeGroup(worker); nodeGroup != "" {
+			log.Printf("Skipping %s of node group %q", worker, nodeGroup)
+			continue
+		}
+		kubectl := func(outWriter io.Writer, args ...string) error {
+			cmdArgs := append([]string{"--kubeconfig", c.AdminKubeconfigPath()}, args...)
+			cmd := exec.CommandContext(ctx, kubectlPath, cmdArgs...)
+			cmd.Stdout = outWriter
+			cmd.Stderr = outWriter
+			if err := cmd.Run(); err != nil {
+				return errors.Wrapf(err, "kubectl %s failed", strings.Join(args, " "))
+			}
+			return nil
+		}
+		if err := c.upgradeMachine(ctx, worker, layerPath, multiPrinter, func(outWriter io.Writer) error {
+			if err := kubectl(outWriter, "drain", worker, "--ignore-daemonsets", "--delete-local-data", "--force", fmt.Sprintf("--timeout=%s", upgradeSettings.DrainTimeout)); err != nil {
+				return err
+			}
+			upgradeNodeCmd := kubeadmUpgradeNodeCmd(targetVersion)
+			if upgradeNodeCmd == nil {
+				return nil
+			}
+			if _, err := machinectl.RunCommandContext(ctx, outWriter, outWriter, "", "shell", worker, upgradeNodeCmd...); err != nil {
+				return errors.Wrap(err, "kubeadm upgrade node failed")
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := kubectl(multiPrinter.NewWriter(fmt.Sprintf("%s ", c.ShortMachineName(worker))), "uncordon", worker); err != nil {
+			return err
+		}
+	}
+
+	if err := c.switchBaseRootfsLayer(layerPath, currentVersionStr); err != nil {
+		return err
+	}
+
+	state.ClusterSettings = &clusterSettings
+	return c.saveState(state)
+}
+
+// upgradeMachine installs the upgraded files from the base rootfs layer
+// on the machine, runs the upgrade step and restarts the kubelet. Output
+// is captured in the machine's `kubeadm-upgrade.log`.
+func (c *Cluster) upgradeMachine(ctx context.Context, machine, layerPath string, multiPrinter *multiprint.Multiprint, upgrade func(outWriter io.Writer) error) error {
+	upgradeLog, err := c.createMachineLog(machine, "kubeadm-upgrade.log")
+	if err != nil {
+		return err
+	}
+	defer upgradeLog.Close()
+	outWriter := io.MultiWriter(upgradeLog, multiPrinter.NewWriter(fmt.Sprintf("%s ", c.ShortMachineName(machine))))
+
+	log.Printf("Upgrading %s ...", machine)
+
+	for _, file := range upgradeFiles {
+		if err := installFile(ctx, machine, path.Join(layerPath, file), "/"+file); err != nil {
+			return errors.Wrapf(err, "failed to install %q on %s", file, machine)
+		}
+	}
+	if err := upgrade(outWriter); err != nil {
+		return errors.Wrapf(err, "failed to upgrade %s (see %s)", machine, upgradeLog.Name())
+	}
+	if _, err := machinectl.RunCommandContext(ctx, outWriter, outWriter, "", "shell", machine, "/bin/sh", "-c", "systemctl daemon-reload && systemctl restart kubelet"); err != nil {
+		return errors.Wrapf(err, "failed to restart kubelet on %s (see %s)", machine, upgradeLog.Name())
+	}
+	return nil
+}
+
+// installFile copies src from the host to dest in the machine. The file
+// is copied next to dest first and then renamed, so that binaries in use
+// (like the kubelet) can be replaced.
+func installFile(ctx context.Context, machine, src, dest string) error {
+	tmpPath := path.Join("/tmp", "kube-spawn-upgrade-"+path.Base(dest))
+	if err := machinectl.ExecContext(ctx, machine, "/bin/rm", "-f", tmpPath); err != nil {
+		return err
+	}
+	if err := machinectl.CopyToContext(ctx, machine, src, tmpPath); err != nil {
+		return err
+	}
+	script := fmt.Sprintf("mkdir -p %[1]s && cp -p %[2]s %[3]s.kube-spawn-new && mv -f %[3]s.kube-spawn-new %[3]s && rm -f %[2]s", path.Dir(dest), tmpPath, dest)
+	return machinectl.ExecContext(ctx, machine, "/bin/sh", "-c", script)
+}
+
+// stageBaseRootfsLayer creates the base rootfs layer at layerPath from
+// the current base rootfs, the Kubernetes files in kubernetesDir and
+// configuration files generated for the new version
+func (c *Cluster) stageBaseRootfsLayer(layerPath, kubernetesDir string, clusterSettings *ClusterSettings) error {
+	if err := os.RemoveAll(layerPath); err != nil {
+		return err
+	}
+	currentPath, err := filepath.EvalSymlinks(c.BaseRootfsPath())
+	if err != nil {
+		return err
+	}
+	if err := fs.CopyTree(currentPath, layerPath); err != nil {
+		return err
+	}
+	for dst, src := range map[string]string{
+		"usr/bin/kubelet":                    "kubelet",
+		"usr/bin/kubeadm":                    "kubeadm",
+		"usr/bin/kubectl":                    "kubectl",
+		"etc/systemd/system/kubelet.service": "kubelet.service",
+		"etc/systemd/system/kubelet.service.d/10-kubeadm.conf": "10-kubeadm.conf",
+	} {
+		if err := fs.LinkOrCopy(path.Join(kubernetesDir, src), path.Join(layerPath, dst)); err != nil {
+			return errors.Wrapf(err, "failed to copy %q", src)
+		}
+	}
+	return prepareBaseRootfs(layerPath, clusterSettings)
+}
+
+// switchBaseRootfsLayer points BaseRootfsPath to the given layer. If the
+// base rootfs is still the directory created by Create, it is moved to
+// the layer path of the previous version first.
+func (c *Cluster) switchBaseRootfsLayer(layerPath, previousVersion string) error {
+	info, err := os.Lstat(c.BaseRootfsPath())
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		if err := os.Rename(c.BaseRootfsPath(), c.baseRootfsLayerPath(previousVersion)); err != nil {
+			return errors.Wrap(err, "failed to move previous base rootfs")
+		}
+	}
+	tmpLink := c.BaseRootfsPath() + ".tmp"
+	os.Remove(tmpLink)
+	if err := os.Symlink(path.Base(layerPath), tmpLink); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpLink, c.BaseRootfsPath()); err != nil {
+		return errors.Wrap(err, "failed to switch base rootfs")
+	}
+	return nil
+}
+
+// removeStaleBaseRootfsLayers removes base rootfs layers not in use
+// anymore. Must only be called when no machines are running, as they
+// keep the layer they were started with mounted.
+func (c *Cluster) removeStaleBaseRootfsLayers() error {
+	current, err := filepath.EvalSymlinks(c.BaseRootfsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		layerPath := path.Join(c.dir, entry.Name())
+		if !entry.IsDir() || !strings.HasPrefix(entry.Name(), "rootfs-base-") || layerPath == current {
+			continue
+		}
+		if err := os.RemoveAll(layerPath); err != nil {
+			return errors.Wrapf(err, "failed to remove stale base rootfs %q", layerPath)
+		}
+	}
+	return nil
+}
+
+func kubeadmPreflightFlags(kubeadmVersion *semver.Version) []string {
+	isLargerEqual19, _ := semver.NewConstraint(">= 1.9")
+	if !isLargerEqual19.Check(kubeadmVersion) {
+		return []string{"--skip-preflight-checks"}
+	}
+	return []string{"--ignore-preflight-errors=all"}
+}
+
+// kubeadmUpgradeNodeCmd returns the command to upgrade the kubelet
+// configuration of a worker. `kubeadm upgrade node` replaced
+// `kubeadm upgrade node config` in 1.15, before 1.11 there is nothing
+// to do besides replacing the binaries.
+func kubeadmUpgradeNodeCmd(kubeadmVersion *semver.Version) []string {
+	isLargerEqual111, _ := semver.NewConstraint(">= 1.11")
+	isLargerEqual115, _ := semver.NewConstraint(">= 1.15")
+	if isLargerEqual115.Check(kubeadmVersion) {
+		return []string{"/usr/bin/kubeadm", "upgrade", "node"}
+	}
+	if !isLargerEqual111.Check(kubeadmVersion) {
+		return nil
+	}
+	return []string{"/usr/bin/kubeadm", "upgrade", "node", "config", "--kubelet-version", fmt.Sprintf("v%s", kubeadmVersion)}
+}
@@ -32,7 +32,11 @@ type CniNetns struct {
 	netns ns.NetNS
 }
 
-func NewCniNetns(cniPluginDir string) (*CniNetns, error) {
+// NewCniNetns creates a network namespace and sets up its network with
+// the CNI bridge plugin. containerId is recorded in the IPAM lease, so
+// that the lease can be found again; if empty, the name of the network
+// namespace is used.
+func NewCniNetns(cniPluginDir, containerId string) (*CniNetns, error) {
 	var err error
 
 	netns, err := ns.NewNS()
@@ -40,8 +44,10 @@ func NewCniNetns(cniPluginDir string) (*CniNetns, error) {
 		return nil, err
 	}
 
-	sNetnsPath := strings.Split(netns.Path(), "/")
-	containerId := sNetnsPath[len(sNetnsPath)-1]
+	if containerId == "" {
+		sNetnsPath := strings.Split(netns.Path(), "/")
+		containerId = sNetnsPath[len(sNetnsPath)-1]
+	}
 
 	cniBridgePluginPath := path.Join(cniPluginDir, "bridge")
 
@@ -23,10 +23,10 @@ import (
 	"syscall"
 )
 
-func Spawn(cniPluginDir string, nspawnArgs []string) error {
+func Spawn(cniPluginDir, containerId string, nspawnArgs []string) error {
 	runtime.LockOSThread()
 
-	cniNetns, err := NewCniNetns(cniPluginDir)
+	cniNetns, err := NewCniNetns(cniPluginDir, containerId)
 	if err != nil {
 		return err
 	}
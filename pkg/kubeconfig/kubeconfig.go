@@ -0,0 +1,252 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package kubeconfig merges cluster credentials into and removes them
+// from kubeconfig files, preserving all unrelated entries.
+package kubeconfig
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v2"
+)
+
+type namedEntry struct {
+	Name string                 `yaml:"name"`
+	Rest map[string]interface{} `yaml:",inline"`
+}
+
+type config struct {
+	APIVersion     string                 `yaml:"apiVersion,omitempty"`
+	Kind           string                 `yaml:"kind,omitempty"`
+	Clusters       []namedEntry           `yaml:"clusters"`
+	Contexts       []namedEntry           `yaml:"contexts"`
+	Users          []namedEntry           `yaml:"users"`
+	CurrentContext string                 `yaml:"current-context"`
+	Rest           map[string]interface{} `yaml:",inline"`
+}
+
+// openDir opens the directory of a kubeconfig without following a
+// symlink and returns its file descriptor and owner. Kubeconfigs are
+// only accessed relative to it, as this runs as root in directories
+// controlled by other users.
+func openDir(dir string) (int, int, error) {
+	dirFd, err := unix.Open(dir, unix.O_RDONLY|unix.O_DIRECTORY|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.ELOOP || err == unix.ENOTDIR {
+			return -1, 0, errors.Errorf("%q is not a directory (symlinks are not supported)", dir)
+		}
+		return -1, 0, errors.Wrapf(err, "failed to open directory %q", dir)
+	}
+	var stat unix.Stat_t
+	if err := unix.Fstat(dirFd, &stat); err != nil {
+		unix.Close(dirFd)
+		return -1, 0, errors.Wrapf(err, "failed to stat %q", dir)
+	}
+	return dirFd, int(stat.Uid), nil
+}
+
+// load reads the kubeconfig at path from the directory dirFd. It has to
+// be a regular file owned by uid, symlinks are not followed. A missing
+// kubeconfig is returned as an empty config and a nil stat.
+func load(dirFd int, path string, uid int) (*config, *unix.Stat_t, error) {
+	// O_NONBLOCK, so that opening a FIFO doesn't hang
+	fd, err := unix.Openat(dirFd, filepath.Base(path), unix.O_RDONLY|unix.O_NOFOLLOW|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if err == unix.ENOENT {
+			return &config{APIVersion: "v1", Kind: "Config"}, nil, nil
+		}
+		if err == unix.ELOOP {
+			return nil, nil, errors.Errorf("%q is a symlink, which is not supported", path)
+		}
+		return nil, nil, errors.Wrapf(err, "failed to open %q", path)
+	}
+	f := os.NewFile(uintptr(fd), path)
+	defer f.Close()
+
+	var stat unix.Stat_t
+	if err := unix.Fstat(fd, &stat); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to stat %q", path)
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFREG {
+		return nil, nil, errors.Errorf("%q is not a regular file", path)
+	}
+	if int(stat.Uid) != uid {
+		return nil, nil, errors.Errorf("%q is owned by uid %d, not by uid %d", path, stat.Uid, uid)
+	}
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to read %q", path)
+	}
+	var cfg config
+	if err := yaml.Unmarshal(content, &cfg); err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to parse kubeconfig %q", path)
+	}
+	return &cfg, &stat, nil
+}
+
+// save writes the config to a temporary file in the directory dirFd,
+// which is then renamed to path, so that a failed write doesn't corrupt
+// an existing kubeconfig. The temporary file is modified through its
+// file descriptor only, so that nothing can be swapped for a symlink
+// meanwhile.
+func save(dirFd int, path string, cfg *config, uid, gid int) error {
+	content, err := yaml.Marshal(cfg)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Dir(path)
+
+	tmpName := fmt.Sprintf(".kube-spawn-config%d", os.Getpid())
+	tmpFd, err := unix.Openat(dirFd, tmpName, unix.O_WRONLY|unix.O_CREAT|unix.O_EXCL|unix.O_NOFOLLOW|unix.O_CLOEXEC, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create temporary file in %q", dir)
+	}
+	tmp := os.NewFile(uintptr(tmpFd), filepath.Join(dir, tmpName))
+	renamed := false
+	defer func() {
+		if !renamed {
+			unix.Unlinkat(dirFd, tmpName, 0)
+		}
+	}()
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to write %q", tmp.Name())
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chown(uid, gid); err != nil {
+		tmp.Close()
+		return errors.Wrapf(err, "failed to chown %q", tmp.Name())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := unix.Renameat(dirFd, tmpName, dirFd, filepath.Base(path)); err != nil {
+		return errors.Wrapf(err, "failed to rename %q to %q", tmp.Name(), path)
+	}
+	renamed = true
+	return nil
+}
+
+func removeEntry(entries []namedEntry, name string) []namedEntry {
+	var kept []namedEntry
+	for _, entry := range entries {
+		if entry.Name != name {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// Merge adds the cluster, user and context of the single-context
+// kubeconfig source (e.g. kubeadm's admin.conf) to the kubeconfig at
+// path, all renamed to name. Existing entries with the same name are
+// replaced. If the kubeconfig has no current context yet, it is set to
+// the new one. The file is created if necessary and owned by uid:gid.
+func Merge(path string, source []byte, name string, uid, gid int) error {
+	var src config
+	if err := yaml.Unmarshal(source, &src); err != nil {
+		return errors.Wrap(err, "failed to parse source kubeconfig")
+	}
+	if len(src.Clusters) != 1 || len(src.Users) != 1 {
+		return errors.Errorf("expected exactly one cluster and user in source kubeconfig, got %d and %d", len(src.Clusters), len(src.Users))
+	}
+
+	// The directory is created for uid if necessary, an existing one has
+	// to belong to uid
+	dir := filepath.Dir(path)
+	if err := os.Mkdir(dir, 0755); err == nil {
+		if err := os.Lchown(dir, uid, gid); err != nil {
+			return errors.Wrapf(err, "failed to chown %q", dir)
+		}
+	} else if !os.IsExist(err) {
+		return errors.Wrapf(err, "failed to create directory %q", dir)
+	}
+	dirFd, owner, err := openDir(dir)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(dirFd)
+	if owner != uid {
+		return errors.Errorf("%q is owned by uid %d, not by uid %d", dir, owner, uid)
+	}
+
+	cfg, _, err := load(dirFd, path, uid)
+	if err != nil {
+		return err
+	}
+
+	cluster := src.Clusters[0]
+	cluster.Name = name
+	user := src.Users[0]
+	user.Name = name
+	context := namedEntry{
+		Name: name,
+		Rest: map[string]interface{}{
+			"context": map[string]interface{}{
+				"cluster": name,
+				"user":    name,
+			},
+		},
+	}
+
+	cfg.Clusters = append(removeEntry(cfg.Clusters, name), cluster)
+	cfg.Users = append(removeEntry(cfg.Users, name), user)
+	cfg.Contexts = append(removeEntry(cfg.Contexts, name), context)
+	if cfg.CurrentContext == "" {
+		cfg.CurrentContext = name
+	}
+
+	return save(dirFd, path, cfg, uid, gid)
+}
+
+// Remove deletes the cluster, user and context with the given name from
+// the kubeconfig at path. A missing kubeconfig is not an error.
+func Remove(path string, name string) error {
+	// The kubeconfig stays owned by the owner of its directory
+	dirFd, uid, err := openDir(filepath.Dir(path))
+	if err != nil {
+		if os.IsNotExist(errors.Cause(err)) {
+			return nil
+		}
+		return err
+	}
+	defer unix.Close(dirFd)
+	cfg, stat, err := load(dirFd, path, uid)
+	if err != nil {
+		return err
+	}
+	if stat == nil {
+		return nil
+	}
+
+	cfg.Clusters = removeEntry(cfg.Clusters, name)
+	cfg.Users = removeEntry(cfg.Users, name)
+	cfg.Contexts = removeEntry(cfg.Contexts, name)
+	if cfg.CurrentContext == name {
+		cfg.CurrentContext = ""
+	}
+
+	return save(dirFd, path, cfg, uid, int(stat.Gid))
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package lock implements advisory file locks which record the PID and
+// command line of the holder, so that a busy lock can be reported in a
+// meaningful way.
+package lock
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// HostLockPath is the lock taken for steps which modify host-level state
+// shared by all clusters, like the machine storage pool or the base image
+const HostLockPath string = "/run/lock/kube-spawn.lock"
+
+const retryInterval = 500 * time.Millisecond
+
+type Lock struct {
+	path string
+	file *os.File
+}
+
+// BusyError is returned when a lock is held by another process
+type BusyError struct {
+	What    string
+	PID     int
+	Command string
+}
+
+func (e *BusyError) Error() string {
+	if e.PID == 0 {
+		return fmt.Sprintf("%s busy, held by another process", e.What)
+	}
+	return fmt.Sprintf("%s busy, held by PID %d running %q", e.What, e.PID, e.Command)
+}
+
+// Acquire takes an exclusive lock on the file at path, creating it if
+// necessary. If the lock is held by another process, Acquire retries
+// until the timeout is reached and then returns a *BusyError. A timeout
+// of zero means to fail immediately. What describes the locked resource
+// in the error message, e.g. `cluster "default"`.
+func Acquire(path, what string, timeout time.Duration) (*Lock, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		err = unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if err == nil {
+			// The file might have been removed (e.g. by `destroy`)
+			// while we were waiting for the lock, in which case
+			// we hold a lock nobody else can see
+			if sameFile(f, path) {
+				l := &Lock{path: path, file: f}
+				if err := l.writeOwner(); err != nil {
+					l.Release()
+					return nil, err
+				}
+				return l, nil
+			}
+			f.Close()
+			continue
+		}
+		if err != unix.EWOULDBLOCK {
+			f.Close()
+			return nil, fmt.Errorf("error locking %s: %v", path, err)
+		}
+		pid, command := readOwner(f)
+		f.Close()
+		if !time.Now().Before(deadline) {
+			return nil, &BusyError{What: what, PID: pid, Command: command}
+		}
+		time.Sleep(retryInterval)
+	}
+}
+
+// AcquireHost takes the host lock, see HostLockPath
+func AcquireHost(timeout time.Duration) (*Lock, error) {
+	if err := os.MkdirAll(filepath.Dir(HostLockPath), 0755); err != nil {
+		return nil, err
+	}
+	return Acquire(HostLockPath, "host setup", timeout)
+}
+
+// Release unlocks and closes the lock file. The file itself is kept
+// to avoid races with other processes waiting for the lock.
+func (l *Lock) Release() error {
+	if err := l.file.Truncate(0); err != nil {
+		l.file.Close()
+		return err
+	}
+	return l.file.Close()
+}
+
+func (l *Lock) writeOwner() error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	content := fmt.Sprintf("%d\n%s\n", os.Getpid(), strings.Join(os.Args, " "))
+	if _, err := l.file.WriteAt([]byte(content), 0); err != nil {
+		return fmt.Errorf("error writing %s: %v", l.path, err)
+	}
+	return nil
+}
+
+func readOwner(f *os.File) (int, string) {
+	content, err := ioutil.ReadAll(f)
+	if err != nil {
+		return 0, ""
+	}
+	var (
+		pid     int
+		command string
+	)
+	s := bufio.NewScanner(strings.NewReader(string(content)))
+	if s.Scan() {
+		pid, _ = strconv.Atoi(strings.TrimSpace(s.Text()))
+	}
+	if s.Scan() {
+		command = strings.TrimSpace(s.Text())
+	}
+	return pid, command
+}
+
+func sameFile(f *os.File, path string) bool {
+	var fdStat, pathStat syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &fdStat); err != nil {
+		return false
+	}
+	if err := syscall.Stat(path, &pathStat); err != nil {
+		return false
+	}
+	return fdStat.Dev == pathStat.Dev && fdStat.Ino == pathStat.Ino
+}
@@ -0,0 +1,31 @@
+package machinectl
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// Journal runs `journalctl --machine` for the given machine and writes
+// the output to stdout. Additional journalctl options, e.g. `--unit`
+// or `--follow`, can be passed with args.
+func Journal(ctx context.Context, stdout io.Writer, machine string, args ...string) error {
+	jPath, err := exec.LookPath("journalctl")
+	if err != nil {
+		return err
+	}
+	cmdArgs := append([]string{"--machine", machine, "--no-pager"}, args...)
+	run := exec.CommandContext(ctx, jPath, cmdArgs...)
+	run.Stdout = stdout
+	var stderr strings.Builder
+	run.Stderr = &stderr
+	if err := run.Run(); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("%q failed: %s", strings.Join(run.Args, " "), strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -3,12 +3,15 @@ package machinectl
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"os/exec"
 	"regexp"
 	"strings"
+	"syscall"
 )
 
 type Machine struct {
@@ -122,24 +125,27 @@ func ListImagesByRegexp(expStr string) ([]Image, error) {
 }
 
 func RunCommand(stdout, stderr io.Writer, opts, cmd, machine string, args ...string) ([]byte, error) {
+	return RunCommandContext(context.Background(), stdout, stderr, opts, cmd, machine, args...)
+}
+
+// RunCommandContext is like RunCommand but kills the machinectl process
+// when the context is done before the command completes
+func RunCommandContext(ctx context.Context, stdout, stderr io.Writer, opts, cmd, machine string, args ...string) ([]byte, error) {
 	mPath, err := exec.LookPath("machinectl")
 	if err != nil {
 		return nil, err
 	}
-	cmdArgs := []string{mPath}
+	var cmdArgs []string
 	if opts != "" {
 		cmdArgs = append(cmdArgs, opts)
 	}
 	cmdArgs = append(cmdArgs, cmd)
 	cmdArgs = append(cmdArgs, machine)
+	cmdArgs = append(cmdArgs, args...)
 
-	run := exec.Cmd{
-		Path:   mPath,
-		Args:   cmdArgs,
-		Stdout: stdout,
-		Stderr: stderr,
-	}
-	run.Args = append(run.Args, args...)
+	run := exec.CommandContext(ctx, mPath, cmdArgs...)
+	run.Stdout = stdout
+	run.Stderr = stderr
 
 	var buf []byte
 
@@ -149,21 +155,104 @@ func RunCommand(stdout, stderr io.Writer, opts, cmd, machine string, args ...str
 		buf, err = run.Output()
 	}
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("%q failed: %s", strings.Join(run.Args, " "), ctx.Err())
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
-			return nil, fmt.Errorf("%q failed: %s", strings.Join(run.Args, " "), exitErr.Stderr)
+			return nil, &CommandError{
+				Command:  strings.Join(run.Args, " "),
+				ExitCode: exitCode(exitErr),
+				Stderr:   exitErr.Stderr,
+			}
 		}
 		return nil, fmt.Errorf("%q failed: %s", strings.Join(run.Args, " "), err)
 	}
 	return buf, nil
 }
 
+// CommandError is returned by RunCommand if machinectl exited with
+// a non-zero exit code. For `machinectl shell`, that is the exit code
+// of the command run in the machine.
+type CommandError struct {
+	Command  string
+	ExitCode int
+	Stderr   []byte
+}
+
+func (e *CommandError) Error() string {
+	if len(e.Stderr) == 0 {
+		return fmt.Sprintf("%q failed with exit code %d", e.Command, e.ExitCode)
+	}
+	return fmt.Sprintf("%q failed: %s", e.Command, e.Stderr)
+}
+
+// ExitCode returns the exit code of a failed command, 0 if err is nil
+// and 1 for errors not caused by a non-zero exit code
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if cmdErr, ok := err.(*CommandError); ok {
+		return cmdErr.ExitCode
+	}
+	return 1
+}
+
+func exitCode(exitErr *exec.ExitError) int {
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+		if status.Signaled() {
+			return 128 + int(status.Signal())
+		}
+		return status.ExitStatus()
+	}
+	return 1
+}
+
+// Shell opens an interactive login shell in the given machine, attached
+// to the terminal of kube-spawn
+func Shell(machine string) error {
+	mPath, err := exec.LookPath("machinectl")
+	if err != nil {
+		return err
+	}
+	run := exec.Command(mPath, "shell", machine)
+	run.Stdin = os.Stdin
+	run.Stdout = os.Stdout
+	run.Stderr = os.Stderr
+	if err := run.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return &CommandError{
+				Command:  strings.Join(run.Args, " "),
+				ExitCode: exitCode(exitErr),
+			}
+		}
+		return err
+	}
+	return nil
+}
+
 func Exec(machine string, cmd ...string) error {
-	_, err := RunCommand(nil, nil, "", "shell", machine, cmd...)
+	return ExecContext(context.Background(), machine, cmd...)
+}
+
+func ExecContext(ctx context.Context, machine string, cmd ...string) error {
+	_, err := RunCommandContext(ctx, nil, nil, "", "shell", machine, cmd...)
 	return err
 }
 
 func Clone(base, dest string) error {
-	_, err := RunCommand(nil, nil, "", "clone", base, dest)
+	return CloneContext(context.Background(), base, dest)
+}
+
+func CloneContext(ctx context.Context, base, dest string) error {
+	_, err := RunCommandContext(ctx, nil, nil, "", "clone", base, dest)
+	return err
+}
+
+// CopyToContext copies a file from the host into the machine. The
+// destination must not exist yet.
+func CopyToContext(ctx context.Context, machine, src, dest string) error {
+	_, err := RunCommandContext(ctx, nil, nil, "", "copy-to", machine, src, dest)
 	return err
 }
 
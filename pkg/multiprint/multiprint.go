@@ -16,6 +16,7 @@ type message struct {
 type Multiprint struct {
 	ctx         context.Context
 	messageChan chan message
+	done        chan struct{}
 }
 
 type Writer struct {
@@ -29,11 +30,13 @@ func New(ctx context.Context) *Multiprint {
 	return &Multiprint{
 		ctx:         ctx,
 		messageChan: make(chan message),
+		done:        make(chan struct{}),
 	}
 }
 
 func (m *Multiprint) RunPrintLoop() {
 	go func() {
+		defer close(m.done)
 		var previousPrefix, prefix string
 		for {
 			select {
@@ -61,6 +64,13 @@ func (m *Multiprint) RunPrintLoop() {
 	}()
 }
 
+// Close stops the print loop after all messages written so far have
+// been printed. Writers must not be used after Close was called.
+func (m *Multiprint) Close() {
+	close(m.messageChan)
+	<-m.done
+}
+
 func (m *Multiprint) NewWriter(prefix string) *Writer {
 	writer := &Writer{
 		ctx:         m.ctx,
@@ -80,6 +90,10 @@ func (w *Writer) Write(p []byte) (n int, err error) {
 	if w.cancelled {
 		return 0, fmt.Errorf("writer was cancelled")
 	}
-	w.messageChan <- message{prefix: w.prefix, value: p}
+	select {
+	case w.messageChan <- message{prefix: w.prefix, value: p}:
+	case <-w.ctx.Done():
+		return 0, fmt.Errorf("writer was cancelled")
+	}
 	return len(p), nil
 }
@@ -17,6 +17,7 @@ limitations under the License.
 package nspawntool
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -30,15 +31,16 @@ import (
 	"github.com/pkg/errors"
 
 	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+	"github.com/kinvolk/kube-spawn/pkg/storage"
 )
 
-func Run(baseImageName, lowerRootPath, upperRootPath, machineName, cniPluginDir string) error {
+func Run(ctx context.Context, storageDriver, baseImageName, lowerRootPath, upperRootPath, machineName, cniPluginDir string) error {
 	if machinectl.IsRunning(machineName) {
 		return errors.Errorf("a machine with name %q is running already", machineName)
 	}
 
-	if err := machinectl.Clone(baseImageName, machineName); err != nil {
-		return errors.Wrap(err, "error cloning image")
+	if err := storage.CreateMachine(ctx, storageDriver, baseImageName, machineName); err != nil {
+		return errors.Wrap(err, "error creating machine image")
 	}
 
 	if err := os.MkdirAll(lowerRootPath, 0755); err != nil {
@@ -100,6 +102,7 @@ func Run(baseImageName, lowerRootPath, upperRootPath, machineName, cniPluginDir
 		kubeSpawnExec,
 		"cni-spawn",
 		"--cni-plugin-dir", cniPluginDir,
+		"--container-id", machineName,
 		"--",
 		"--machine", machineName,
 		optionsOverlay("--overlay", "/etc", lowerRootPath, upperRootPath),
@@ -111,10 +114,7 @@ func Run(baseImageName, lowerRootPath, upperRootPath, machineName, cniPluginDir
 		args = append(args, fmt.Sprintf("--bind=%s:%s", path.Join(upperRootPath, d), d))
 	}
 
-	c := &exec.Cmd{
-		Path: systemdRunExec,
-		Args: append([]string{systemdRunExec}, args...),
-	}
+	c := exec.CommandContext(ctx, systemdRunExec, args...)
 	c.Stderr = os.Stderr
 
 	stdout, err := c.StdoutPipe()
@@ -144,15 +144,19 @@ func Run(baseImageName, lowerRootPath, upperRootPath, machineName, cniPluginDir
 		return errors.Wrap(&cniError, "error running cnispawn")
 	}
 
-	return waitMachinesRunning(machineName)
+	return waitMachinesRunning(ctx, machineName)
 }
 
-func waitMachinesRunning(machineName string) error {
+func waitMachinesRunning(ctx context.Context, machineName string) error {
 	for retries := 0; retries <= 30; retries++ {
 		if machinectl.IsRunning(machineName) {
 			return nil
 		}
-		time.Sleep(2 * time.Second)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "waiting for %q to start", machineName)
+		case <-time.After(2 * time.Second):
+		}
 	}
 	return errors.Errorf("timeout waiting for %q to start", machineName)
 }
@@ -0,0 +1,251 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+// The overlay driver keeps its data in a hidden directory of the pool,
+// which machined ignores. bases/<image> is the extracted root filesystem
+// of a raw base image, with bases/<image>.stamp identifying the version
+// of the raw image. layers/<machine> holds the upper and work directories
+// of a machine and the path of its lower directory in the file `lower`.
+//
+// The overlay itself is mounted on /var/lib/machines/<machine>, so that
+// machinectl and systemd-nspawn find the machine image as usual.
+var overlayDir = path.Join(machinesDir, ".kube-spawn")
+
+// exportDir is where the extraction directory is mounted in the
+// container running tar
+const exportDir = "/run/kube-spawn-export"
+
+// LayerPath returns the directory with the overlay layers of a machine
+func LayerPath(machineName string) string {
+	return path.Join(overlayDir, "layers", machineName)
+}
+
+func basePath(imageName string) string {
+	return path.Join(overlayDir, "bases", imageName)
+}
+
+// OverlayBases returns the paths of the extracted base images by image
+// name
+func OverlayBases() (map[string]string, error) {
+	basesDir := path.Join(overlayDir, "bases")
+	entries, err := ioutil.ReadDir(basesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	bases := make(map[string]string)
+	for _, entry := range entries {
+		if entry.IsDir() && !strings.HasSuffix(entry.Name(), ".tmp") {
+			bases[entry.Name()] = path.Join(basesDir, entry.Name())
+		}
+	}
+	return bases, nil
+}
+
+// overlayLower returns the lower directory for machines of the base
+// image, which is the image itself for directory images
+func overlayLower(imageName string) (string, error) {
+	imagePath := path.Join(machinesDir, imageName)
+	if info, err := os.Stat(imagePath); err == nil && info.IsDir() {
+		return imagePath, nil
+	}
+	if _, err := os.Stat(basePath(imageName)); err != nil {
+		return "", errors.Errorf("base image %q hasn't been extracted for the overlay storage driver", imageName)
+	}
+	return basePath(imageName), nil
+}
+
+// prepareOverlayBase extracts the raw base image, unless it has been
+// extracted already, and returns the lower directory for its machines
+func prepareOverlayBase(ctx context.Context, imageName string) (string, error) {
+	imagePath := path.Join(machinesDir, imageName)
+	if info, err := os.Stat(imagePath); err == nil && info.IsDir() {
+		return imagePath, nil
+	}
+
+	rawPath := imagePath + ".raw"
+	info, err := os.Stat(rawPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", errors.Errorf("image %q not found in %s", imageName, machinesDir)
+		}
+		return "", err
+	}
+	stamp := fmt.Sprintf("%d %d\n", info.Size(), info.ModTime().UnixNano())
+
+	dest := basePath(imageName)
+	stampPath := dest + ".stamp"
+	if oldStamp, err := ioutil.ReadFile(stampPath); err == nil && string(oldStamp) == stamp {
+		if _, err := os.Stat(dest); err == nil {
+			return dest, nil
+		}
+	}
+
+	users, err := layersUsing(dest)
+	if err != nil {
+		return "", err
+	}
+	if len(users) > 0 {
+		return "", errors.Errorf("image %q changed, but machines still use the extracted copy of the old one, stop them first: %s", imageName, strings.Join(users, " "))
+	}
+
+	if err := extractRawImage(ctx, rawPath, dest); err != nil {
+		return "", err
+	}
+	if err := ioutil.WriteFile(stampPath, []byte(stamp), 0644); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+// extractRawImage copies the root filesystem of the raw image to dest.
+// systemd-nspawn takes care of finding the root partition.
+func extractRawImage(ctx context.Context, rawPath, dest string) error {
+	nspawnPath, err := exec.LookPath("systemd-nspawn")
+	if err != nil {
+		return fmt.Errorf("systemd-nspawn not installed: %s", err)
+	}
+
+	tmpDest := dest + ".tmp"
+	if err := os.RemoveAll(tmpDest); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDest, 0755); err != nil {
+		return err
+	}
+
+	// The API filesystems are mounted by systemd-nspawn, only their
+	// mount points are copied
+	var excludes []string
+	for _, dir := range []string{"dev", "proc", "run", "sys", "tmp"} {
+		excludes = append(excludes, fmt.Sprintf("--exclude='./%s/*'", dir))
+	}
+	script := fmt.Sprintf("tar -C / --numeric-owner %s -cf - . | tar -C %s --numeric-owner -xpf -", strings.Join(excludes, " "), exportDir)
+
+	var out bytes.Buffer
+	cmd := exec.CommandContext(ctx, nspawnPath,
+		"--quiet",
+		"--register=no",
+		"--read-only",
+		"--private-network",
+		"--image="+rawPath,
+		"--bind="+tmpDest+":"+exportDir,
+		"--",
+		"/bin/sh", "-c", script)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	if err := cmd.Run(); err != nil {
+		os.RemoveAll(tmpDest)
+		return errors.Wrapf(err, "failed to extract %s: %s", rawPath, strings.TrimSpace(out.String()))
+	}
+
+	if err := os.RemoveAll(dest); err != nil {
+		return err
+	}
+	return os.Rename(tmpDest, dest)
+}
+
+// layersUsing returns the machines with the given lower directory
+func layersUsing(lower string) ([]string, error) {
+	layersDir := path.Join(overlayDir, "layers")
+	entries, err := ioutil.ReadDir(layersDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var machines []string
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(path.Join(layersDir, entry.Name(), "lower"))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		if strings.TrimSpace(string(content)) == lower {
+			machines = append(machines, entry.Name())
+		}
+	}
+	return machines, nil
+}
+
+func createOverlayMachine(baseImageName, machineName string) error {
+	lower, err := overlayLower(baseImageName)
+	if err != nil {
+		return err
+	}
+
+	target := path.Join(machinesDir, machineName)
+	if _, err := os.Lstat(target); err == nil {
+		return errors.Errorf("image %q exists already", machineName)
+	}
+	layer := LayerPath(machineName)
+	if _, err := os.Lstat(layer); err == nil {
+		return errors.Errorf("overlay layer %q exists already", layer)
+	}
+
+	upper := path.Join(layer, "upper")
+	work := path.Join(layer, "work")
+	for _, dir := range []string{upper, work, target} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			removeOverlayMachine(machineName)
+			return err
+		}
+	}
+	if err := ioutil.WriteFile(path.Join(layer, "lower"), []byte(lower+"\n"), 0644); err != nil {
+		removeOverlayMachine(machineName)
+		return err
+	}
+
+	options := fmt.Sprintf("lowerdir=%s,upperdir=%s,workdir=%s", lower, upper, work)
+	if err := unix.Mount("overlay", target, "overlay", 0, options); err != nil {
+		removeOverlayMachine(machineName)
+		return errors.Wrapf(err, "failed to mount overlay on %s", target)
+	}
+	return nil
+}
+
+func removeOverlayMachine(machineName string) error {
+	target := path.Join(machinesDir, machineName)
+	// EINVAL means target isn't mounted (anymore), e.g. after a reboot
+	if err := unix.Unmount(target, 0); err != nil && err != unix.EINVAL && err != unix.ENOENT {
+		return errors.Wrapf(err, "failed to unmount %s", target)
+	}
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(LayerPath(machineName))
+}
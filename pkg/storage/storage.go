@@ -0,0 +1,108 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package storage creates and removes the root filesystems of the
+// machines in /var/lib/machines. With the btrfs driver they are cloned
+// from the base image with `machinectl clone`, which is cheap on btrfs
+// but a full copy on other filesystems. With the overlay driver they are
+// overlayfs mounts over a single extracted copy of the base image.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+
+	"github.com/kinvolk/kube-spawn/pkg/machinectl"
+)
+
+const (
+	DriverAuto    = "auto"
+	DriverBtrfs   = "btrfs"
+	DriverOverlay = "overlay"
+
+	machinesDir = "/var/lib/machines"
+)
+
+// Drivers returns the names accepted by ResolveDriver
+func Drivers() []string {
+	return []string{DriverAuto, DriverBtrfs, DriverOverlay}
+}
+
+// ResolveDriver validates the driver name and resolves DriverAuto (or
+// an empty name) to btrfs if /var/lib/machines is on btrfs, or else to
+// overlay
+func ResolveDriver(name string) (string, error) {
+	switch name {
+	case DriverBtrfs, DriverOverlay:
+		return name, nil
+	case DriverAuto, "":
+	default:
+		return "", errors.Errorf("unknown storage driver %q, expected one of %s", name, strings.Join(Drivers(), ", "))
+	}
+
+	var stat unix.Statfs_t
+	if err := unix.Statfs(machinesDir, &stat); err != nil {
+		return "", errors.Wrapf(err, "failed to determine filesystem of %s", machinesDir)
+	}
+	if stat.Type == unix.BTRFS_SUPER_MAGIC {
+		return DriverBtrfs, nil
+	}
+	return DriverOverlay, nil
+}
+
+// Prepare is called with the host lock held before machines are created
+// from the base image with the given driver
+func Prepare(ctx context.Context, driver, baseImageName string) error {
+	if driver != DriverOverlay {
+		return nil
+	}
+	if _, err := prepareOverlayBase(ctx, baseImageName); err != nil {
+		return errors.Wrapf(err, "failed to prepare base image %q for the overlay storage driver", baseImageName)
+	}
+	return nil
+}
+
+// CreateMachine creates the image for the machine from the base image
+func CreateMachine(ctx context.Context, driver, baseImageName, machineName string) error {
+	switch driver {
+	case DriverBtrfs:
+		return machinectl.CloneContext(ctx, baseImageName, machineName)
+	case DriverOverlay:
+		return createOverlayMachine(baseImageName, machineName)
+	}
+	return fmt.Errorf("unknown storage driver %q", driver)
+}
+
+// RemoveMachine removes the image of a stopped machine, whichever driver
+// created it
+func RemoveMachine(machineName string) error {
+	if IsOverlayMachine(machineName) {
+		return removeOverlayMachine(machineName)
+	}
+	return machinectl.Remove(machineName)
+}
+
+// IsOverlayMachine returns true if the image of the machine was created
+// by the overlay driver
+func IsOverlayMachine(machineName string) bool {
+	_, err := os.Stat(LayerPath(machineName))
+	return err == nil
+}
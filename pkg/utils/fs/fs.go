@@ -36,17 +36,37 @@ func PathExists(path string) (bool, error) {
 	return true, err
 }
 
+// CreateFileFromReader writes the content of reader to path. The file
+// is written next to path and renamed over it, so that an existing file,
+// which might share its inode with others (see LinkOrCopy), is replaced
+// instead of modified.
 func CreateFileFromReader(path string, reader io.Reader) error {
+	return createFileFromReader(path, reader, 0755)
+}
+
+func createFileFromReader(path string, reader io.Reader, mode os.FileMode) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, os.FileMode(0755)); err != nil {
 		return errors.Wrapf(err, "error creating directory %q", dir)
 	}
-	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+	tmpPath := path + tmpSuffix
+	// a left over temporary file would keep its mode
+	os.Remove(tmpPath)
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, mode)
 	if err != nil {
 		return errors.Wrapf(err, "error creating %q", path)
 	}
-	defer f.Close()
 	if _, err := io.Copy(f, reader); err != nil {
+		f.Close()
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmpPath)
+		return errors.Wrapf(err, "error writing %q", path)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
 		return errors.Wrapf(err, "error writing %q", path)
 	}
 	return nil
@@ -57,6 +77,12 @@ func CreateFileFromString(path string, content string) error {
 	return CreateFileFromReader(path, buf)
 }
 
+// CreatePrivateFileFromString is like CreateFileFromString, but the file
+// is only readable by its owner, e.g. because it contains credentials
+func CreatePrivateFileFromString(path string, content string) error {
+	return createFileFromReader(path, bytes.NewBufferString(content), 0600)
+}
+
 func CopyFile(src, dst string) error {
 	f, err := os.OpenFile(src, os.O_RDONLY, 0755)
 	if err != nil {
@@ -65,3 +91,36 @@ func CopyFile(src, dst string) error {
 	defer f.Close()
 	return CreateFileFromReader(dst, f)
 }
+
+// CopyTree recursively copies the directory src to dst, preserving file
+// modes and symlinks
+func CopyTree(src, dst string) error {
+	return filepath.Walk(src, func(srcPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, srcPath)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dstPath, info.Mode().Perm())
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(srcPath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case info.Mode().IsRegular():
+			if err := CopyFile(srcPath, dstPath); err != nil {
+				return errors.Wrapf(err, "error copying %q", srcPath)
+			}
+			return os.Chmod(dstPath, info.Mode().Perm())
+		default:
+			return errors.Errorf("unsupported file type of %q", srcPath)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// suffix of the temporary files which are renamed over their
+	// destination once complete
+	tmpSuffix = ".kube-spawn-tmp"
+
+	// FICLONE from linux/fs.h, not in our version of x/sys/unix
+	ficlone = 0x40049409
+)
+
+// LinkOrCopy creates dst with the content of src as cheaply as the
+// filesystems allow: as a hardlink if both are on the same filesystem,
+// as a reflink (FICLONE, e.g. on btrfs and XFS) if supported, otherwise
+// as a copy. An existing dst is replaced atomically.
+//
+// As dst may share its inode with src, neither must be modified in place
+// afterwards, only replaced like CreateFileFromReader does.
+func LinkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return errors.Wrapf(err, "error creating directory %q", filepath.Dir(dst))
+	}
+	tmpPath := dst + tmpSuffix
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.Link(src, tmpPath); err != nil {
+		if err := cloneOrCopy(src, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, dst); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// cloneOrCopy creates dst as a reflink of src or, if the filesystem
+// doesn't support that, as a copy, with the mode of src
+func cloneOrCopy(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return errors.Wrapf(err, "error creating %q", dst)
+	}
+	defer out.Close()
+
+	if _, _, errno := unix.Syscall(unix.SYS_IOCTL, out.Fd(), ficlone, in.Fd()); errno != 0 {
+		if _, err := io.Copy(out, in); err != nil {
+			return errors.Wrapf(err, "error copying %q to %q", src, dst)
+		}
+	}
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package fs
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// DiskUsage returns the disk space allocated for the file or directory
+// tree at path in bytes, like `du -s`. Files with several hardlinks in
+// the tree are only counted once. Files which vanish during the walk are
+// skipped.
+func DiskUsage(path string) (int64, error) {
+	type inode struct {
+		dev uint64
+		ino uint64
+	}
+	seen := make(map[inode]bool)
+	var usage int64
+	err := filepath.Walk(path, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filePath != path {
+				return nil
+			}
+			return err
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			usage += info.Size()
+			return nil
+		}
+		if stat.Nlink > 1 && !info.IsDir() {
+			key := inode{dev: uint64(stat.Dev), ino: stat.Ino}
+			if seen[key] {
+				return nil
+			}
+			seen[key] = true
+		}
+		size, err := AllocatedSize(info)
+		if err != nil {
+			return err
+		}
+		usage += size
+		return nil
+	})
+	return usage, err
+}
+
+// AllocatedSize returns the disk space allocated for the file described
+// by info in bytes, which is less than its size for sparse files
+func AllocatedSize(info os.FileInfo) (int64, error) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, errors.Errorf("cannot determine allocated size of %s", info.Name())
+	}
+	// st_blocks is in 512 byte units regardless of the block size
+	return stat.Blocks * 512, nil
+}
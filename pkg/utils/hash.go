@@ -17,35 +17,60 @@
 package utils
 
 import (
-	"crypto/sha1"
-	"encoding/base64"
-	"io/ioutil"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"hash"
+	"io"
+	"os"
 	"strings"
 
 	"github.com/pkg/errors"
 )
 
-func VerifySha1(binFilePath, checksumPath string) error {
-	outB, err := ioutil.ReadFile(binFilePath)
-	if err != nil {
-		return errors.Wrapf(err, "error reading file %s", binFilePath)
+const (
+	SHA256 = "sha256"
+	SHA512 = "sha512"
+)
+
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case SHA256:
+		return sha256.New(), nil
+	case SHA512:
+		return sha512.New(), nil
+	default:
+		return nil, errors.Errorf("unsupported hash algorithm %q", algorithm)
 	}
+}
 
-	outC, err := ioutil.ReadFile(checksumPath)
+// FileDigest returns the hex encoded digest of the file. The file is
+// read in chunks, not into memory as a whole.
+func FileDigest(filePath, algorithm string) (string, error) {
+	hasher, err := newHash(algorithm)
 	if err != nil {
-		return errors.Wrapf(err, "error reading file %s", checksumPath)
+		return "", err
 	}
-
-	hasher := sha1.New()
-	if _, err := hasher.Write(outB); err != nil {
-		return errors.Wrapf(err, "error reading for hash from %s", binFilePath)
+	f, err := os.Open(filePath)
+	if err != nil {
+		return "", errors.Wrapf(err, "error reading file %s", filePath)
 	}
-
-	hashSha := base64.URLEncoding.EncodeToString(hasher.Sum(nil))
-
-	if strings.TrimSpace(hashSha) != strings.TrimSpace(string(outC)) {
-		return errors.Wrapf(err, "error verifying checksum for file %s", binFilePath)
+	defer f.Close()
+	if _, err := io.Copy(hasher, f); err != nil {
+		return "", errors.Wrapf(err, "error reading for hash from %s", filePath)
 	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
 
+// VerifyFileDigest compares the digest of the file with the expected
+// hex encoded digest
+func VerifyFileDigest(filePath, algorithm, expected string) error {
+	digest, err := FileDigest(filePath, algorithm)
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(digest, strings.TrimSpace(expected)) {
+		return errors.Errorf("%s checksum mismatch for %s: expected %s, got %s", algorithm, filePath, expected, digest)
+	}
 	return nil
 }
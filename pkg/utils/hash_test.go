@@ -0,0 +1,110 @@
+/*
+Copyright 2019 Kinvolk GmbH
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package utils
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const (
+	helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+	helloSHA512 = "9b71d224bd62f3785d96d46ad3ea3d73319bfbc2890caadae2dff72519673ca72323c3d99ba5c11d7c7acc6e14b8c5da0c4663475c2e5c3adef46f73bcdec043"
+)
+
+func writeTestFile(t *testing.T, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "kube-spawn-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	filePath := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(filePath, []byte(content), 0644); err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	return filePath, func() { os.RemoveAll(dir) }
+}
+
+func TestFileDigest(t *testing.T) {
+	filePath, cleanup := writeTestFile(t, "hello")
+	defer cleanup()
+
+	tests := []struct {
+		algorithm string
+		digest    string
+		err       string
+	}{
+		{SHA256, helloSHA256, ""},
+		{SHA512, helloSHA512, ""},
+		{"md5", "", `unsupported hash algorithm "md5"`},
+	}
+	for _, test := range tests {
+		digest, err := FileDigest(filePath, test.algorithm)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: expected error %q, got %v", test.algorithm, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.algorithm, err)
+			continue
+		}
+		if digest != test.digest {
+			t.Errorf("%s: expected %s, got %s", test.algorithm, test.digest, digest)
+		}
+	}
+
+	if _, err := FileDigest(filePath+".missing", SHA256); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestVerifyFileDigest(t *testing.T) {
+	filePath, cleanup := writeTestFile(t, "hello")
+	defer cleanup()
+
+	tests := []struct {
+		name      string
+		algorithm string
+		expected  string
+		err       string
+	}{
+		{"sha256", SHA256, helloSHA256, ""},
+		{"sha512", SHA512, helloSHA512, ""},
+		{"upper case", SHA256, strings.ToUpper(helloSHA256), ""},
+		{"trailing newline", SHA256, helloSHA256 + "\n", ""},
+		{"mismatch", SHA256, helloSHA512[:64], "sha256 checksum mismatch for " + filePath},
+		{"wrong algorithm", SHA512, helloSHA256, "sha512 checksum mismatch"},
+		{"empty", SHA256, "", "checksum mismatch"},
+	}
+	for _, test := range tests {
+		err := VerifyFileDigest(filePath, test.algorithm, test.expected)
+		if test.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: expected error %q, got %v", test.name, test.err, err)
+		}
+	}
+}